@@ -1,63 +1,151 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"strings"
 )
 
 // APIServer represents an HTTP server for handling API requests.
 type APIServer struct {
-	listenAddr string
-	store      Storage
-	Router     *mux.Router
+	config    ServerConfig
+	store     Storage
+	monitor   *StationMonitor
+	retention *RetentionJob
+	throttle  *ReadingThrottle
+	Router    *mux.Router
+
+	// handler serves the requests with Router, logging and tracing them,
+	// including those matching no route
+	handler http.Handler
 }
 
 // NewAPIServer creates a new instance of APIServer.
-func NewAPIServer(listenAddr string, store Storage) *APIServer {
+func NewAPIServer(config ServerConfig, store Storage, monitor *StationMonitor, retention *RetentionJob, limiter *RateLimiter, throttle *ReadingThrottle, verifier *SignatureVerifier, authorizer *Authorizer) *APIServer {
 	router := mux.NewRouter()
 
 	server := &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
-		Router:     router,
+		config:    config,
+		store:     store,
+		monitor:   monitor,
+		retention: retention,
+		throttle:  throttle,
+		Router:    router,
 	}
 
+	// The middlewares of the router only run for the requests matching a
+	// route, so requests are logged and traced around it, those over the
+	// rate limits or answered 404 and 405 too. Devices are only limited once
+	// authenticated, so that none can spend the limit of another
+	server.handler = matchRoutes(router, traceRequests(logRequests(limiter.limitClients(router))))
+
+	// Permissions required per method, other methods are left to admins
+	read := routePermissions{http.MethodGet: PermissionRead}
+	edit := routePermissions{http.MethodPost: PermissionEdit}
+	readOrEdit := routePermissions{
+		http.MethodGet:    PermissionRead,
+		http.MethodPost:   PermissionEdit,
+		http.MethodPut:    PermissionEdit,
+		http.MethodDelete: PermissionEdit,
+	}
+	admin := routePermissions{}
+
+	// The health check stays open to monitoring
 	router.HandleFunc("/api/healthcheck", makeHTTPHandlerFunc(server.handleHealth))
-	router.HandleFunc("/api/weather", makeHTTPHandlerFunc(server.handleWeather))
-	router.HandleFunc("/api/weather/{id}", makeHTTPHandlerFunc(server.handleWeatherWithID))
-	router.HandleFunc("/api/cities", makeHTTPHandlerFunc(server.handleCity))
-	router.HandleFunc("/api/cities/{id}", makeHTTPHandlerFunc(server.handleCityWithID))
-	router.HandleFunc("/api/predictions", makeHTTPHandlerFunc(server.handlePrediction))
+
+	handle := func(path string, permissions routePermissions, f apiFunc) {
+		router.Handle(path, authorizer.authorize(permissions, limiter.limitDevices(includeDeleted(makeHTTPHandlerFunc(f)))))
+	}
+	// Readings may be changed by the devices, which sign their requests
+	handleSigned := func(path string, permissions routePermissions, f apiFunc) {
+		router.Handle(path, authorizer.authorize(permissions, verifier.verifySignatures(limiter.limitDevices(includeDeleted(makeHTTPHandlerFunc(f))))))
+	}
+	handleSigned("/api/weather", routePermissions{http.MethodGet: PermissionRead, http.MethodPost: PermissionIngest}, server.handleWeather)
+	handleSigned("/api/weather/import", edit, server.handleWeatherImport)
+	handleSigned("/api/weather/{id}", read, server.handleWeatherWithID)
+	handle("/api/cities", routePermissions{http.MethodGet: PermissionRead, http.MethodPost: PermissionEdit}, server.handleCity)
+	handle("/api/cities/{id}", read, server.handleCityWithID)
+	handle("/api/cities/{id}/restore", admin, server.handleCityRestore)
+	handle("/api/cities/{id}/retention", read, server.handleRetentionPolicyWithID)
+	handle("/api/retention", read, server.handleRetention)
+	handle("/api/retention/policies", read, server.handleRetentionPolicy)
+	handle("/api/predictions", readOrEdit, server.handlePrediction)
+	handle("/api/predictions/evaluate", edit, server.handlePredictionEvaluation)
+	handle("/api/predictions/scores", read, server.handlePredictionScores)
+	handle("/api/predictions/import", edit, server.handlePredictionImport)
+	handle("/api/predictions/{id}", readOrEdit, server.handlePredictionWithID)
+	// Devices and tokens hold secrets, so they are only managed over the
+	// API when it requires tokens
+	if authorizer.enabled {
+		handle("/api/devices", admin, server.handleDevice)
+		handle("/api/devices/{id}/secret", admin, server.handleDeviceSecret)
+		handle("/api/devices/{id}", admin, server.handleDeviceWithID)
+		handle("/api/tokens", admin, server.handleAPIToken)
+		handle("/api/tokens/{id}", admin, server.handleAPITokenWithID)
+	}
+	handle("/api/audit", admin, server.handleAudit)
+	handle("/api/stations", read, server.handleStation)
+	handle("/api/stations/{id}", read, server.handleStationWithID)
 
 	return server
 }
 
-// Run starts the API server and listens for incoming requests.
-func (server *APIServer) Run() {
-	log.Println("JSON API server running on port: ", server.listenAddr)
-
-	allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
-	origins := strings.Split(allowedOrigins, ",")
+// Run starts the API server and listens for incoming requests until ctx
+// is done, then shuts it down gracefully. Requests still running once the
+// shutdown timeout is over are cut off, which is logged rather than
+// returned so that the caller goes on closing the jobs and the database;
+// only failing to serve is an error.
+func (server *APIServer) Run(ctx context.Context) error {
+	slog.Info("JSON API server running", "addr", server.config.ListenAddr)
 
 	c := cors.New(cors.Options{
-		AllowedOrigins:   origins,
+		AllowedOrigins:   server.config.AllowedOrigins,
 		AllowCredentials: true,
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", requestIDHeader, deviceIDHeader, idempotencyKeyHeader, signatureHeader, signatureTimestampHeader, signatureNonceHeader},
+		ExposedHeaders:   []string{requestIDHeader, "Retry-After", readingStatusHeader, idempotentReplayedHeader},
 		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
 	})
 
-	handler := c.Handler(server.Router)
-
 	// Use the CORS-wrapped handler as your HTTP server's handler
-	err := http.ListenAndServe(server.listenAddr, handler)
-	if err != nil {
-		log.Fatal(err)
+	httpServer := &http.Server{
+		Addr:              server.config.ListenAddr,
+		Handler:           c.Handler(server.handler),
+		ReadTimeout:       server.config.ReadTimeout.Duration,
+		ReadHeaderTimeout: server.config.ReadHeaderTimeout.Duration,
+		WriteTimeout:      server.config.WriteTimeout.Duration,
+		IdleTimeout:       server.config.IdleTimeout.Duration,
 	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stop accepting connections and let in-flight requests finish
+	slog.Info("JSON API server shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), server.config.ShutdownTimeout.Duration)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("JSON API server shutdown", "error", err)
+		if err := httpServer.Close(); err != nil {
+			slog.Error("closing JSON API server", "error", err)
+		}
+	}
+	return nil
 }
 
 // handleHealth sends a 200 status code.
@@ -96,6 +184,16 @@ func (server *APIServer) handleWeatherWithID(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// handleWeatherImport handles bulk imports of historical weather data.
+func (server *APIServer) handleWeatherImport(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return server.handleImportWeathers(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
 // handleCity handles city data operations.
 func (server *APIServer) handleCity(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
@@ -122,13 +220,193 @@ func (server *APIServer) handleCityWithID(w http.ResponseWriter, r *http.Request
 	}
 }
 
-// handlePrediction handles prediction creation.
+// handleCityRestore handles the restoration of a deleted city.
+func (server *APIServer) handleCityRestore(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return server.handleRestoreCity(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleRetentionPolicyWithID handles the retention policy of a city.
+func (server *APIServer) handleRetentionPolicyWithID(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetRetentionPolicy(w, r)
+	case http.MethodPut:
+		return server.handleUpdateRetentionPolicy(w, r)
+	case http.MethodDelete:
+		return server.handleDeleteRetentionPolicy(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleRetention handles retention job metrics retrieval.
+func (server *APIServer) handleRetention(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetRetentionStats(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleRetentionPolicy handles retention policies retrieval.
+func (server *APIServer) handleRetentionPolicy(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetRetentionPolicies(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handlePrediction handles prediction operations.
 func (server *APIServer) handlePrediction(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case http.MethodGet:
 		return server.handleGetPredictions(w, r)
 	case http.MethodPost:
 		return server.handleCreatePrediction(w, r)
+	case http.MethodPut:
+		return server.handleUpsertPredictions(w, r)
+	case http.MethodDelete:
+		return server.handleDeletePredictions(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handlePredictionWithID handles prediction operations by ID.
+func (server *APIServer) handlePredictionWithID(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetPredictionByID(w, r)
+	case http.MethodPut:
+		return server.handleUpdatePrediction(w, r)
+	case http.MethodDelete:
+		return server.handleDeletePrediction(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handlePredictionEvaluation handles scoring predictions against observed readings.
+func (server *APIServer) handlePredictionEvaluation(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return server.handleEvaluatePredictions(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handlePredictionImport handles importing external forecast files.
+func (server *APIServer) handlePredictionImport(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return server.handleImportPredictions(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handlePredictionScores handles retrieval of persisted forecast scores.
+func (server *APIServer) handlePredictionScores(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetForecastScores(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleDevice handles the devices signing their requests.
+func (server *APIServer) handleDevice(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetDevices(w, r)
+	case http.MethodPost:
+		return server.handleCreateDevice(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleDeviceWithID handles a device by ID.
+func (server *APIServer) handleDeviceWithID(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetDeviceByID(w, r)
+	case http.MethodDelete:
+		return server.handleDeleteDevice(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleDeviceSecret handles the rotation of a device secret.
+func (server *APIServer) handleDeviceSecret(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return server.handleRotateDeviceSecret(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleAPIToken handles the API tokens.
+func (server *APIServer) handleAPIToken(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetAPITokens(w, r)
+	case http.MethodPost:
+		return server.handleCreateAPIToken(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleAPITokenWithID handles an API token by ID.
+func (server *APIServer) handleAPITokenWithID(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetAPITokenByID(w, r)
+	case http.MethodDelete:
+		return server.handleDeleteAPIToken(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleAudit handles the audit log retrieval.
+func (server *APIServer) handleAudit(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetAudit(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleStation handles station status retrieval.
+func (server *APIServer) handleStation(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetStations(w, r)
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+}
+
+// handleStationWithID handles station status retrieval by city ID.
+func (server *APIServer) handleStationWithID(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return server.handleGetStationByID(w, r)
 	default:
 		return fmt.Errorf("unsupported method: %s", r.Method)
 	}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (server *APIServer) handleGetAudit(w http.ResponseWriter, r *http.Request) error {
+	query := AuditQuery{
+		Entity:   r.URL.Query().Get("entity"),
+		EntityID: r.URL.Query().Get("entity_id"),
+		Actor:    r.URL.Query().Get("actor"),
+		Limit:    defaultAuditLimit,
+	}
+
+	if r.URL.Query().Get("from") != "" {
+		from, err := getTimeParam(r, "from", time.Time{})
+		if err != nil {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		query.From = &from
+	}
+	if r.URL.Query().Get("to") != "" {
+		to, err := getTimeParam(r, "to", time.Time{})
+		if err != nil {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		query.To = &to
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a number from 1 to " + strconv.Itoa(maxAuditLimit)})
+		}
+		query.Limit = n
+	}
+
+	entries, err := server.store.GetAuditEntries(r.Context(), query)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, entries)
+}
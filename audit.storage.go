@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// auditedTables lists the tables whose changes are recorded, under which
+// entity name, keyed by which column, and for which operations. Readings
+// are created by the stations and predictions mostly by the forecaster, so
+// only their edits are recorded.
+var auditedTables = []struct {
+	table, entity, key, operations string
+}{
+	{"weather", "weather", "id", "UPDATE OR DELETE"},
+	{"predictions", "prediction", "id", "UPDATE OR DELETE"},
+	{"cities", "city", "id", "INSERT OR UPDATE OR DELETE"},
+	{"retention_policies", "retention_policy", "city_id", "INSERT OR UPDATE OR DELETE"},
+	{"devices", "device", "id", "INSERT OR UPDATE OR DELETE"},
+	{"api_tokens", "api_token", "id", "INSERT OR UPDATE OR DELETE"},
+}
+
+// CreateAuditLog creates the audit log and the triggers recording in it,
+// within the transaction of each change, the rows of the audited tables
+// before and after it. The actor and request are taken from the
+// weather.actor, weather.actor_name and weather.request_id settings, see
+// inAuditedTx, and
+// maintenance which moves or prunes data in bulk sets weather.skip_audit.
+func (s *PostgresStore) CreateAuditLog(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS audit_log (
+            id BIGSERIAL PRIMARY KEY,
+            at TIMESTAMP NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC'),
+            actor TEXT NOT NULL,
+            actor_name TEXT NULL,
+            request_id TEXT NULL,
+            entity TEXT NOT NULL,
+            entity_id TEXT NOT NULL,
+            action TEXT NOT NULL,
+            before JSONB NULL,
+            after JSONB NULL
+        );
+
+        ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS actor_name TEXT NULL;
+
+        CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity, entity_id);
+        CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor);
+    `)
+	if err != nil {
+		return err
+	}
+
+	// The function is replaced on every start so existing databases pick up
+	// changes. Changes made outside of the API are attributed to the
+	// database user, and marking a row deleted or bringing it back is
+	// recorded as a delete or a restore
+	_, err = s.db.ExecContext(ctx, `
+        CREATE OR REPLACE FUNCTION audit_change()
+        RETURNS TRIGGER AS $$
+        DECLARE
+            before_row JSONB;
+            after_row JSONB;
+            action TEXT := lower(TG_OP);
+        BEGIN
+            IF current_setting('weather.skip_audit', true) = 'on' THEN
+                RETURN NULL;
+            END IF;
+
+            IF TG_OP IN ('UPDATE', 'DELETE') THEN
+                before_row := to_jsonb(OLD) - 'secret' - 'token_hash';
+            END IF;
+            IF TG_OP IN ('INSERT', 'UPDATE') THEN
+                after_row := to_jsonb(NEW) - 'secret' - 'token_hash';
+            END IF;
+
+            IF TG_OP = 'UPDATE' THEN
+                IF before_row ->> 'deleted_at' IS NULL AND after_row ->> 'deleted_at' IS NOT NULL THEN
+                    action := 'delete';
+                ELSIF before_row ->> 'deleted_at' IS NOT NULL AND after_row ->> 'deleted_at' IS NULL THEN
+                    action := 'restore';
+                END IF;
+            END IF;
+
+            INSERT INTO audit_log (actor, actor_name, request_id, entity, entity_id, action, before, after)
+            VALUES (
+                COALESCE(NULLIF(current_setting('weather.actor', true), ''), session_user),
+                NULLIF(current_setting('weather.actor_name', true), ''),
+                NULLIF(current_setting('weather.request_id', true), ''),
+                TG_ARGV[0],
+                COALESCE(after_row, before_row) ->> TG_ARGV[1],
+                action,
+                before_row,
+                after_row
+            );
+            RETURN NULL;
+        END;
+        $$ LANGUAGE plpgsql;
+    `)
+	if err != nil {
+		return err
+	}
+
+	for _, audited := range auditedTables {
+		name := audited.table + "_audit_trigger"
+
+		// Check if the trigger already exists
+		var triggerExists bool
+		err = s.db.QueryRowContext(ctx, `
+			SELECT EXISTS(
+				SELECT 1 FROM pg_trigger 
+				WHERE tgname = $1 
+				AND tgrelid = $2::regclass)
+		`, name, audited.table).Scan(&triggerExists)
+		if err != nil {
+			return err
+		}
+		if triggerExists {
+			continue
+		}
+
+		// DDL doesn't take parameters; the names are constants
+		_, err = s.db.ExecContext(ctx, fmt.Sprintf(`
+			CREATE TRIGGER %s
+			AFTER %s ON %s
+			FOR EACH ROW
+			EXECUTE FUNCTION audit_change('%s', '%s');
+		`, name, audited.operations, audited.table, audited.entity, audited.key))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inAuditedTx runs fn in a transaction whose changes are recorded in the
+// audit log as made by the principal of ctx, or anonymous when the
+// request isn't authenticated, in the request of ctx. Principals are
+// recorded by their ID, as several tokens may share a name, and their
+// name is kept alongside for reading.
+func (s *PostgresStore) inAuditedTx(ctx context.Context, fn func(tx *tracedTx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	actor, actorName := "anonymous", ""
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		actor, actorName = principal.ID, principal.Name
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		SELECT set_config('weather.actor', $1, true), set_config('weather.actor_name', $2, true), set_config('weather.request_id', $3, true)
+	`, actor, actorName, RequestIDFromContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetAuditEntries(ctx context.Context, q AuditQuery) ([]*AuditEntry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	var args []any
+	if q.Entity != "" {
+		args = append(args, q.Entity)
+		conditions = append(conditions, fmt.Sprintf("entity = $%d", len(args)))
+	}
+	if q.EntityID != "" {
+		args = append(args, q.EntityID)
+		conditions = append(conditions, fmt.Sprintf("entity_id = $%d", len(args)))
+	}
+	if q.Actor != "" {
+		args = append(args, q.Actor)
+		conditions = append(conditions, fmt.Sprintf("actor = $%d", len(args)))
+	}
+	if q.From != nil {
+		args = append(args, *q.From)
+		conditions = append(conditions, fmt.Sprintf("at >= $%d", len(args)))
+	}
+	if q.To != nil {
+		args = append(args, *q.To)
+		conditions = append(conditions, fmt.Sprintf("at < $%d", len(args)))
+	}
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, at, actor, actor_name, request_id, entity, entity_id, action, before, after 
+		FROM audit_log 
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY id DESC
+		LIMIT $`+fmt.Sprint(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry := new(AuditEntry)
+		var before, after []byte
+		err := rows.Scan(
+			&entry.ID,
+			&entry.At,
+			&entry.Actor,
+			&entry.ActorName,
+			&entry.RequestID,
+			&entry.Entity,
+			&entry.EntityID,
+			&entry.Action,
+			&before,
+			&after,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entry.Before = before
+		entry.After = after
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
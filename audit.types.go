@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Bounds of the audit log entries listed at once.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditEntry records a change of an entity: who made it, in which request,
+// and the entity before and after it. Secrets are left out.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	At        time.Time       `json:"at"`
+	Actor     string          `json:"actor"`
+	ActorName *string         `json:"actor_name,omitempty"`
+	RequestID *string         `json:"request_id,omitempty"`
+	Entity    string          `json:"entity"`
+	EntityID  string          `json:"entity_id"`
+	Action    string          `json:"action"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditQuery narrows the audit log entries listed, most recent first.
+type AuditQuery struct {
+	Entity   string
+	EntityID string
+	Actor    string
+	From     *time.Time
+	To       *time.Time
+	Limit    int
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// routePermissions gives the permission required by each method of a
+// route. Methods not listed require PermissionAdmin.
+type routePermissions map[string]string
+
+// Principal is who a request is made by: its API token, or the device
+// whose signature was verified. ID tells principals apart, while several
+// tokens may share a Name.
+type Principal struct {
+	ID   string
+	Name string
+	Role string
+}
+
+// devicePrincipal returns the principal of the requests signed by a
+// device.
+func devicePrincipal(deviceID string) Principal {
+	return Principal{ID: "device:" + deviceID, Name: deviceID, Role: RoleStation}
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns who the request ctx belongs to is made by,
+// if authenticated.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// Authorizer checks that requests carry an API token whose role grants the
+// permission required by their route and method.
+type Authorizer struct {
+	store          Storage
+	enabled        bool
+	adminTokenHash string
+}
+
+// NewAuthorizer creates a new instance of Authorizer. A disabled authorizer
+// lets every request through.
+func NewAuthorizer(store Storage, cfg AuthConfig) *Authorizer {
+	authorizer := &Authorizer{
+		store:   store,
+		enabled: cfg.Enabled,
+	}
+	if cfg.AdminToken != "" {
+		authorizer.adminTokenHash = hashAPIToken(cfg.AdminToken)
+	}
+	return authorizer
+}
+
+// authorize wraps the handler of a route so that it only serves the
+// requests allowed by permissions. Requests without a valid token are
+// answered with http.StatusUnauthorized and those whose role lacks the
+// permission with http.StatusForbidden. Signed device requests are let
+// through to ingest without a principal, for the signature check to vouch
+// for them, see verifySignatures.
+func (a *Authorizer) authorize(permissions routePermissions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		permission, ok := permissions[r.Method]
+		if !ok {
+			permission = PermissionAdmin
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get(authorizationHeader), "Bearer ")
+		if !found || token == "" {
+			if permission == PermissionIngest && r.Header.Get(signatureHeader) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, r, http.StatusUnauthorized, "API token required")
+			return
+		}
+
+		principal, err := a.authenticate(r.Context(), token)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeAPIError(w, r, http.StatusUnauthorized, "invalid API token")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, r, errorStatus(err), err.Error())
+			return
+		}
+
+		if !RoleCan(principal.Role, permission) {
+			writeAPIError(w, r, http.StatusForbidden, "role "+principal.Role+" may not "+permission+" here")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// authenticate returns who token belongs to. The error of an unknown token
+// wraps sql.ErrNoRows.
+func (a *Authorizer) authenticate(ctx context.Context, token string) (Principal, error) {
+	hash := hashAPIToken(token)
+	if a.adminTokenHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.adminTokenHash)) == 1 {
+		return Principal{ID: "token:admin", Name: "admin", Role: RoleAdmin}, nil
+	}
+
+	apiToken, err := a.store.GetAPITokenByHash(ctx, hash)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{ID: "token:" + apiToken.ID, Name: apiToken.Name, Role: apiToken.Role}, nil
+}
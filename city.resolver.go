@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// maxCityDistanceKm is how far an imported location may be from the
+// coordinates of a city to be matched to it.
+const maxCityDistanceKm = 25.0
+
+// cityResolver maps the city references of imported rows to city IDs.
+type cityResolver struct {
+	cities []*City
+	byID   map[string]*City
+	byName map[string][]*City
+}
+
+func newCityResolver(ctx context.Context, store Storage) (*cityResolver, error) {
+	cities, err := store.GetCities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &cityResolver{
+		cities: cities,
+		byID:   make(map[string]*City, len(cities)),
+		byName: make(map[string][]*City, len(cities)),
+	}
+	for _, city := range cities {
+		resolver.byID[city.ID] = city
+		name := strings.ToLower(city.Name)
+		resolver.byName[name] = append(resolver.byName[name], city)
+	}
+	return resolver, nil
+}
+
+// resolve returns the city ID referenced by an imported row, trying the
+// city ID, name and coordinates in that order. A name shared by several
+// cities is refused rather than guessed.
+func (c *cityResolver) resolve(cityID, cityName string, latitude, longitude *float64) (string, error) {
+	if cityID != "" {
+		if _, ok := c.byID[strings.ToLower(cityID)]; !ok {
+			return "", fmt.Errorf("city [%s] not found", cityID)
+		}
+		return strings.ToLower(cityID), nil
+	}
+
+	if cityName != "" {
+		cities := c.byName[strings.ToLower(cityName)]
+		switch len(cities) {
+		case 0:
+			return "", fmt.Errorf("city %q not found", cityName)
+		case 1:
+			return cities[0].ID, nil
+		default:
+			return "", fmt.Errorf("city name %q is ambiguous, %d cities have it", cityName, len(cities))
+		}
+	}
+
+	if latitude != nil && longitude != nil {
+		return c.nearest(*latitude, *longitude)
+	}
+
+	return "", fmt.Errorf("no city given")
+}
+
+// nearest returns the closest city with coordinates within maxCityDistanceKm.
+func (c *cityResolver) nearest(latitude, longitude float64) (string, error) {
+	var nearest *City
+	best := math.Inf(1)
+	for _, city := range c.cities {
+		if city.Latitude == nil || city.Longitude == nil {
+			continue
+		}
+		distance := haversineKm(latitude, longitude, *city.Latitude, *city.Longitude)
+		if distance < best {
+			best = distance
+			nearest = city
+		}
+	}
+
+	if nearest == nil || best > maxCityDistanceKm {
+		return "", fmt.Errorf("no city within %.0f km of %.4f, %.4f", maxCityDistanceKm, latitude, longitude)
+	}
+	return nearest.ID, nil
+}
+
+// haversineKm returns the great-circle distance between two coordinates.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// firstNonEmpty returns the first of values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
 	"net/http"
 )
 
@@ -13,18 +15,20 @@ func (server *APIServer) handleCreateCity(w http.ResponseWriter, r *http.Request
 
 	city, err := NewCity(
 		req.Name,
+		req.Latitude,
+		req.Longitude,
 	)
 	if err != nil {
 		return err
 	}
 
-	err = server.store.CreateCity(city)
+	err = server.store.CreateCity(r.Context(), city)
 	if err != nil {
 		return err
 	}
 
 	// Recovering city from DB
-	createdCity, err := server.store.GetCityByID(city.ID)
+	createdCity, err := server.store.GetCityByID(r.Context(), city.ID)
 	if err != nil {
 		return err
 	}
@@ -38,7 +42,7 @@ func (server *APIServer) handleGetCityByID(w http.ResponseWriter, r *http.Reques
 		return err
 	}
 
-	city, err := server.store.GetCityByID(id)
+	city, err := server.store.GetCityByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
@@ -46,8 +50,8 @@ func (server *APIServer) handleGetCityByID(w http.ResponseWriter, r *http.Reques
 	return WriteJSON(w, http.StatusOK, city)
 }
 
-func (server *APIServer) handleGetCities(w http.ResponseWriter, _ *http.Request) error {
-	cities, err := server.store.GetCities()
+func (server *APIServer) handleGetCities(w http.ResponseWriter, r *http.Request) error {
+	cities, err := server.store.GetCities(r.Context())
 	if err != nil {
 		return err
 	}
@@ -60,7 +64,7 @@ func (server *APIServer) handleUpdateCity(w http.ResponseWriter, r *http.Request
 		return err
 	}
 
-	_, err = server.store.GetCityByID(id)
+	_, err = server.store.GetCityByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
@@ -72,12 +76,12 @@ func (server *APIServer) handleUpdateCity(w http.ResponseWriter, r *http.Request
 
 	city.ID = id
 
-	if err := server.store.UpdateCity(&city); err != nil {
+	if err := server.store.UpdateCity(r.Context(), &city); err != nil {
 		return err
 	}
 
 	// Recovering data from DB to get the most up-to-date data
-	updatedCity, err := server.store.GetCityByID(city.ID)
+	updatedCity, err := server.store.GetCityByID(r.Context(), city.ID)
 	if err != nil {
 		return err
 	}
@@ -91,10 +95,57 @@ func (server *APIServer) handleDeleteCity(w http.ResponseWriter, r *http.Request
 		return err
 	}
 
-	err = server.store.DeleteCity(id)
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = CityDeleteRefuse
+	}
+
+	var targetID string
+	switch mode {
+	case CityDeleteRefuse, CityDeleteCascade:
+	case CityDeleteReassign:
+		target, err := uuid.Parse(query.Get("reassign_to"))
+		if err != nil {
+			return fmt.Errorf("reassign_to must be the ID of a city")
+		}
+		if target == uuid.MustParse(id) {
+			return fmt.Errorf("a city can't be reassigned to itself")
+		}
+		targetID = target.String()
+	default:
+		return fmt.Errorf("mode must be %s, %s or %s", CityDeleteRefuse, CityDeleteCascade, CityDeleteReassign)
+	}
+
+	deletion, err := server.store.DeleteCity(r.Context(), id, mode, targetID)
+	if err != nil {
+		return err
+	}
+
+	if deletion.Deleted == "" {
+		// Nothing was changed, the client has to pick what becomes of them
+		deletion.Error = fmt.Sprintf("city [%s] has %d readings and %d predictions, use mode %s or %s", id, deletion.Readings, deletion.Predictions, CityDeleteCascade, CityDeleteReassign)
+		return WriteJSON(w, http.StatusConflict, deletion)
+	}
+
+	return WriteJSON(w, http.StatusOK, deletion)
+}
+
+func (server *APIServer) handleRestoreCity(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	err = server.store.RestoreCity(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	restoredCity, err := server.store.GetCityByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": id})
+	return WriteJSON(w, http.StatusOK, restoredCity)
 }
@@ -1,14 +1,30 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"github.com/lib/pq"
+	"log/slog"
+	"time"
 )
 
-func (s *PostgresStore) CreateCityTable() error {
+// cityDependentTables lists the tables referencing cities.
+var cityDependentTables = []string{
+	"weather",
+	"predictions",
+	"forecast_scores",
+	"weather_hourly_rollups",
+	"weather_daily_rollups",
+	"retention_policies",
+}
+
+// cityColumns lists the cities columns in the order expected by scanIntoCity.
+const cityColumns = "id, name, created_at, updated_at, latitude, longitude, deleted_at"
+
+func (s *PostgresStore) CreateCityTable(ctx context.Context) error {
 	// Create the table if it doesn't exist
-	_, err := s.db.Exec(`
+	_, err := s.db.ExecContext(ctx, `
         CREATE TABLE IF NOT EXISTS cities (
             id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
             name TEXT NOT NULL,
@@ -20,9 +36,27 @@ func (s *PostgresStore) CreateCityTable() error {
 		return err
 	}
 
+	// Coordinates used to match external forecasts to cities
+	_, err = s.db.ExecContext(ctx, `
+        ALTER TABLE cities ADD COLUMN IF NOT EXISTS latitude FLOAT NULL;
+        ALTER TABLE cities ADD COLUMN IF NOT EXISTS longitude FLOAT NULL;
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Deleted cities are kept, along with their readings and predictions,
+	// until purged once past the grace period
+	_, err = s.db.ExecContext(ctx, `
+        ALTER TABLE cities ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP NULL;
+    `)
+	if err != nil {
+		return err
+	}
+
 	// Check if the trigger already exists
 	var triggerExists bool
-	err = s.db.QueryRow(`
+	err = s.db.QueryRowContext(ctx, `
 		SELECT EXISTS(
 			SELECT 1 FROM pg_trigger 
          	WHERE tgname = 'cities_updated_at_trigger' 
@@ -35,7 +69,7 @@ func (s *PostgresStore) CreateCityTable() error {
 	// Create the trigger only if it doesn't exist
 	if !triggerExists {
 		// Create the trigger
-		_, err = s.db.Exec(`
+		_, err = s.db.ExecContext(ctx, `
             CREATE OR REPLACE FUNCTION update_city_timestamp()
             RETURNS TRIGGER AS $$
             BEGIN
@@ -59,7 +93,7 @@ func (s *PostgresStore) CreateCityTable() error {
 	}
 
 	// Check if the createdAt trigger already exists
-	err = s.db.QueryRow(`
+	err = s.db.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 FROM pg_trigger 
             WHERE tgname = 'cities_created_at_trigger' 
@@ -72,7 +106,7 @@ func (s *PostgresStore) CreateCityTable() error {
 	// Create the trigger only if it doesn't exist
 	if !triggerExists {
 		// Create the trigger for created_at
-		_, err = s.db.Exec(`
+		_, err = s.db.ExecContext(ctx, `
             CREATE OR REPLACE FUNCTION set_city_created_at()
             RETURNS TRIGGER AS $$
             BEGIN
@@ -94,18 +128,26 @@ func (s *PostgresStore) CreateCityTable() error {
 	return nil
 }
 
-func (s *PostgresStore) CreateCity(city *City) error {
+func (s *PostgresStore) CreateCity(ctx context.Context, city *City) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-		INSERT INTO cities (name, updated_at) 
-		VALUES ($1, NULL)
+		INSERT INTO cities (name, latitude, longitude, updated_at) 
+		VALUES ($1, $2, $3, NULL)
 		RETURNING id
 	`
 
 	var id string
-	err := s.db.QueryRow(
-		query,
-		city.Name,
-	).Scan(&id)
+	err := s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		return tx.QueryRowContext(
+			ctx,
+			query,
+			city.Name,
+			city.Latitude,
+			city.Longitude,
+		).Scan(&id)
+	})
 	if err != nil {
 		return err
 	}
@@ -116,16 +158,19 @@ func (s *PostgresStore) CreateCity(city *City) error {
 	return nil
 }
 
-func (s *PostgresStore) GetCityByID(id string) (*City, error) {
-	rows, err := s.db.Query("SELECT * FROM cities WHERE id = $1", id)
+func (s *PostgresStore) GetCityByID(ctx context.Context, id string) (*City, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+cityColumns+" FROM cities WHERE id = $1 AND "+notDeleted(ctx), id)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(rows *sql.Rows) {
+	defer func(rows *tracedRows) {
 		err := rows.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}(rows)
 
@@ -136,28 +181,34 @@ func (s *PostgresStore) GetCityByID(id string) (*City, error) {
 	return nil, fmt.Errorf("city [%s] not found", id)
 }
 
-func scanIntoCity(rows *sql.Rows) (*City, error) {
+func scanIntoCity(rows *tracedRows) (*City, error) {
 	city := new(City)
 	err := rows.Scan(
 		&city.ID,
 		&city.Name,
 		&city.CreatedAt,
 		&city.UpdatedAt,
+		&city.Latitude,
+		&city.Longitude,
+		&city.DeletedAt,
 	)
 
 	return city, err
 }
 
-func (s *PostgresStore) GetCities() ([]*City, error) {
-	rows, err := s.db.Query("SELECT * FROM cities")
+func (s *PostgresStore) GetCities(ctx context.Context) ([]*City, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+cityColumns+" FROM cities WHERE "+notDeleted(ctx))
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(rows *sql.Rows) {
+	defer func(rows *tracedRows) {
 		err := rows.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}(rows)
 
@@ -173,35 +224,322 @@ func (s *PostgresStore) GetCities() ([]*City, error) {
 	return cities, nil
 }
 
-func (s *PostgresStore) UpdateCity(city *City) error {
+func (s *PostgresStore) UpdateCity(ctx context.Context, city *City) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		UPDATE cities 
-		SET name = $1, updated_at = NOW() 
-		WHERE id = $2
+		SET name = $1, latitude = $2, longitude = $3, updated_at = NOW() 
+		WHERE id = $4 AND deleted_at IS NULL
 	`
 
-	_, err := s.db.Exec(
-		query,
-		city.Name,
-		city.ID,
-	)
-	if err != nil {
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		_, err := tx.ExecContext(
+			ctx,
+			query,
+			city.Name,
+			city.Latitude,
+			city.Longitude,
+			city.ID,
+		)
 		return err
+	})
+}
+
+// DeleteCity marks the city deleted, in one transaction with what mode
+// does to its readings and predictions: CityDeleteRefuse keeps the city if
+// it has any, CityDeleteCascade deletes them along with it and
+// CityDeleteReassign moves them to the city targetID. Deleted rows are
+// then left out of the queries until the city is restored or purged. A
+// refused deletion is returned without Deleted. The error of a city not
+// found wraps sql.ErrNoRows.
+func (s *PostgresStore) DeleteCity(ctx context.Context, id, mode, targetID string) (*CityDeletion, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	deletion := &CityDeletion{Mode: mode}
+	err := s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		// Locking the city holds off the readings and predictions added to
+		// it meanwhile
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT TRUE FROM cities WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("city [%s] not found: %w", id, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		if mode == CityDeleteReassign {
+			err := tx.QueryRowContext(ctx, "SELECT TRUE FROM cities WHERE id = $1 AND deleted_at IS NULL FOR SHARE", targetID).Scan(&exists)
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("city [%s] to reassign to not found: %w", targetID, err)
+			}
+			if err != nil {
+				return err
+			}
+			deletion.ReassignedTo = targetID
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			SELECT 
+				(SELECT COUNT(*) FROM weather WHERE city_id = $1 AND deleted_at IS NULL),
+				(SELECT COUNT(*) FROM predictions WHERE city_id = $1 AND deleted_at IS NULL)
+		`, id).Scan(&deletion.Readings, &deletion.Predictions)
+		if err != nil {
+			return err
+		}
+
+		if mode == CityDeleteRefuse && (deletion.Readings > 0 || deletion.Predictions > 0) {
+			return nil
+		}
+
+		var deletedAt time.Time
+		err = tx.QueryRowContext(ctx, `
+			UPDATE cities 
+			SET deleted_at = NOW() 
+			WHERE id = $1
+			RETURNING deleted_at
+		`, id).Scan(&deletedAt)
+		if err != nil {
+			return err
+		}
+		deletion.Deleted = id
+
+		// The city alone stands for its readings and predictions in the
+		// audit log
+		_, err = tx.ExecContext(ctx, "SET LOCAL weather.skip_audit = 'on'")
+		if err != nil {
+			return err
+		}
+
+		switch mode {
+		case CityDeleteCascade:
+			// The readings and predictions share the deletion time of the
+			// city, telling them apart from those deleted on their own when
+			// restored
+			for _, table := range []string{"weather", "predictions"} {
+				_, err = tx.ExecContext(ctx, `
+					UPDATE `+table+` SET deleted_at = $2 
+					WHERE city_id = $1 AND deleted_at IS NULL
+				`, id, deletedAt)
+				if err != nil {
+					return err
+				}
+			}
+		case CityDeleteReassign:
+			deletion.RetentionPolicyDropped, err = reassignCity(ctx, tx, id, targetID)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return deletion, nil
 }
 
-func (s *PostgresStore) DeleteCity(id string) error {
-	query := `
-		DELETE FROM cities 
-		WHERE id = $1
-	`
+// reassignCity moves the readings, predictions and forecast scores of the
+// city from to the city to. The aggregates of from, which hold its
+// readings and those pruned, are merged into those of to before the
+// readings are moved without the rollup triggers, so that the hours of
+// both keep their minimums and maximums. The readings moved then follow
+// the retention policy of to, and it reports whether from had a policy of
+// its own, which is left behind.
+func reassignCity(ctx context.Context, tx *tracedTx, from, to string) (bool, error) {
+	// The names are constants
+	for _, rollup := range []struct{ table, period string }{
+		{"weather_hourly_rollups", "hour"},
+		{"weather_daily_rollups", "day"},
+	} {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`
+			WITH moved AS (
+				DELETE FROM %[1]s 
+				WHERE city_id = $1
+				RETURNING %[2]s, reading_count, temperature_sum, humidity_sum,
+					temperature_min, temperature_max, humidity_min, humidity_max
+			)
+			INSERT INTO %[1]s AS r (
+				city_id, %[2]s, reading_count, temperature_sum, humidity_sum,
+				temperature_min, temperature_max, humidity_min, humidity_max
+			)
+			SELECT $2::uuid, %[2]s, reading_count, temperature_sum, humidity_sum,
+				temperature_min, temperature_max, humidity_min, humidity_max
+			FROM moved
+			ON CONFLICT (city_id, %[2]s) DO UPDATE 
+			SET reading_count = r.reading_count + EXCLUDED.reading_count,
+				temperature_sum = r.temperature_sum + EXCLUDED.temperature_sum,
+				humidity_sum = r.humidity_sum + EXCLUDED.humidity_sum,
+				temperature_min = LEAST(r.temperature_min, EXCLUDED.temperature_min),
+				temperature_max = GREATEST(r.temperature_max, EXCLUDED.temperature_max),
+				humidity_min = LEAST(r.humidity_min, EXCLUDED.humidity_min),
+				humidity_max = GREATEST(r.humidity_max, EXCLUDED.humidity_max)
+		`, rollup.table, rollup.period), from, to)
+		if err != nil {
+			return false, err
+		}
+	}
 
-	_, err := s.db.Exec(query, id)
+	_, err := tx.ExecContext(ctx, "SELECT set_config('weather.skip_rollup', 'on', true)")
 	if err != nil {
-		return err
+		return false, err
+	}
+	for _, table := range []string{"weather", "predictions"} {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE `+table+` SET city_id = $2 
+			WHERE city_id = $1 AND deleted_at IS NULL
+		`, from, to)
+		if err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "SELECT set_config('weather.skip_rollup', 'off', true)")
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	_, err = tx.ExecContext(ctx, "UPDATE forecast_scores SET city_id = $2 WHERE city_id = $1", from, to)
+	if err != nil {
+		return false, err
+	}
+
+	var hasPolicy bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM retention_policies WHERE city_id = $1)", from).Scan(&hasPolicy)
+	return hasPolicy, err
+}
+
+// RestoreCity brings back a deleted city along with the readings and
+// predictions deleted with it. The error of a deleted city not found
+// wraps sql.ErrNoRows.
+func (s *PostgresStore) RestoreCity(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		var deletedAt time.Time
+		err := tx.QueryRowContext(ctx, `
+			SELECT deleted_at FROM cities 
+			WHERE id = $1 AND deleted_at IS NOT NULL
+			FOR UPDATE
+		`, id).Scan(&deletedAt)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("deleted city [%s] not found: %w", id, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE cities SET deleted_at = NULL WHERE id = $1", id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "SET LOCAL weather.skip_audit = 'on'")
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"weather", "predictions"} {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE `+table+` SET deleted_at = NULL 
+				WHERE city_id = $1 AND deleted_at = $2
+			`, id, deletedAt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PurgeDeletedCities deletes for good the cities deleted before cutoff,
+// with everything stored about them, and returns how many were purged.
+func (s *PostgresStore) PurgeDeletedCities(ctx context.Context, cutoff time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Their aggregates go with them, and their deletion is already in the
+	// audit log
+	_, err = tx.ExecContext(ctx, "SET LOCAL weather.skip_rollup = 'on'; SET LOCAL weather.skip_audit = 'on'")
+	if err != nil {
+		return 0, err
+	}
+
+	// Lock the cities so none is restored meanwhile
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM cities WHERE deleted_at < $1 FOR UPDATE", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Dependent rows first, for the foreign keys
+	for _, table := range cityDependentTables {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE city_id = ANY($1::uuid[])", pq.Array(ids))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM cities WHERE id = ANY($1::uuid[])", pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit()
+}
+
+// GetExistingCityIDs returns which of the given city IDs exist and aren't
+// deleted. The IDs must be valid UUIDs.
+func (s *PostgresStore) GetExistingCityIDs(ctx context.Context, ids []string) (map[string]bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM cities WHERE id = ANY($1::uuid[]) AND deleted_at IS NULL", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	existing := make(map[string]bool, len(ids))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+
+	return existing, nil
 }
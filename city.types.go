@@ -7,16 +7,46 @@ type City struct {
 	Name      string     `json:"name"`
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Latitude  *float64   `json:"latitude,omitempty"`
+	Longitude *float64   `json:"longitude,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type CreateCityRequest struct {
-	Name string `json:"name"`
+	Name      string   `json:"name"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
 }
 
 func NewCity(
 	name string,
+	latitude *float64,
+	longitude *float64,
 ) (*City, error) {
 	return &City{
-		Name: name,
+		Name:      name,
+		Latitude:  latitude,
+		Longitude: longitude,
 	}, nil
 }
+
+// Modes of deleting a city with readings or predictions.
+const (
+	CityDeleteRefuse   = "refuse"
+	CityDeleteCascade  = "cascade"
+	CityDeleteReassign = "reassign"
+)
+
+// CityDeletion reports how a city was deleted and what became of its
+// readings and predictions, or why it was not.
+type CityDeletion struct {
+	Deleted      string `json:"deleted,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Mode         string `json:"mode"`
+	Readings     int64  `json:"readings"`
+	Predictions  int64  `json:"predictions"`
+	ReassignedTo string `json:"reassigned_to,omitempty"`
+	// The retention policy of a reassigned city isn't followed by the
+	// readings moved
+	RetentionPolicyDropped bool `json:"retention_policy_dropped,omitempty"`
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"time"
+)
+
+// runCommand runs the command line command given in args against the store.
+func runCommand(ctx context.Context, store Storage, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: %s import predictions|weather [flags] | rebuild rollups [flags] | token create [flags] | config print", os.Args[0])
+	}
+
+	// Changes made from the command line are audited as such
+	ctx = context.WithValue(ctx, principalKey{}, Principal{ID: "cli", Name: "cli", Role: RoleAdmin})
+
+	switch args[0] + " " + args[1] {
+	case "import predictions":
+		return runImportPredictions(ctx, store, args[2:])
+	case "import weather":
+		return runImportWeather(ctx, store, args[2:])
+	case "rebuild rollups":
+		return runRebuildRollups(ctx, store, args[2:])
+	case "token create":
+		return runCreateAPIToken(ctx, store, args[2:])
+	default:
+		return fmt.Errorf("unknown command: %s %s", args[0], args[1])
+	}
+}
+
+// runImportPredictions imports an external forecast file from disk.
+func runImportPredictions(ctx context.Context, store Storage, args []string) error {
+	flags := flag.NewFlagSet("import predictions", flag.ContinueOnError)
+	file := flags.String("file", "", "path of the forecast file to import")
+	format := flags.String("format", PredictionImportOpenMeteo, "file format: open-meteo or csv")
+	cityID := flags.String("city-id", "", "city ID every row belongs to")
+	cityName := flags.String("city", "", "city name every row belongs to")
+	source := flags.String("source", "", "source stored with the predictions (default: the format)")
+	model := flags.String("model", "", "model stored with the predictions")
+	issuedAt := flags.String("issued-at", "", "RFC 3339 time the forecast was issued (default: now)")
+	partial := flags.Bool("partial", false, "import the valid rows even if some are rejected")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+
+	opts := PredictionImportOptions{
+		Format:   *format,
+		CityID:   *cityID,
+		CityName: *cityName,
+		Source:   *source,
+		Model:    *model,
+		Partial:  *partial,
+	}
+	if *issuedAt != "" {
+		t, err := time.Parse(time.RFC3339, *issuedAt)
+		if err != nil {
+			return fmt.Errorf("-issued-at must be an RFC 3339 timestamp")
+		}
+		opts.IssuedAt = &t
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result, importErr := ImportPredictions(ctx, store, f, opts)
+	if result != nil {
+		if err := printJSON(result); err != nil {
+			return err
+		}
+	}
+
+	return importErr
+}
+
+// runImportWeather bulk loads historical readings from a CSV file on disk.
+func runImportWeather(ctx context.Context, store Storage, args []string) error {
+	flags := flag.NewFlagSet("import weather", flag.ContinueOnError)
+	file := flags.String("file", "", "path of the CSV file to import")
+	mapping := flags.String("mapping", "", "field=column pairs, e.g. temperature=temp_c,humidity=rh,city=station,timestamp=time")
+	timeFormat := flags.String("time-format", "rfc3339", "Go time layout of the timestamp column, or rfc3339 or unix")
+	timezone := flags.String("timezone", "UTC", "time zone of timestamps without an offset")
+	cityID := flags.String("city-id", "", "city ID every row belongs to")
+	cityName := flags.String("city", "", "city name every row belongs to")
+	dryRun := flags.Bool("dry-run", false, "only report the rows that would be rejected")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+
+	columns, err := parseWeatherMapping(*mapping)
+	if err != nil {
+		return err
+	}
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result, err := ImportWeatherCSV(ctx, store, f, WeatherImportOptions{
+		Mapping:    columns,
+		TimeFormat: *timeFormat,
+		Location:   location,
+		CityID:     *cityID,
+		CityName:   *cityName,
+		DryRun:     *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	return printJSON(result)
+}
+
+// printConfig writes the effective configuration to the standard output as
+// YAML, with the secrets redacted.
+func printConfig(cfg *Config) error {
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// printJSON writes v to the standard output as indented JSON.
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// runRebuildRollups recomputes the hourly aggregates from the readings, for
+// backfills and repairs.
+func runRebuildRollups(ctx context.Context, store Storage, args []string) error {
+	flags := flag.NewFlagSet("rebuild rollups", flag.ContinueOnError)
+	cityID := flags.String("city-id", "", "city to rebuild (default: every city)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	rebuilt, err := store.RebuildHourlyRollups(ctx, *cityID)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(map[string]int64{"rebuilt_hours": rebuilt})
+}
+
+// runCreateAPIToken creates an API token and prints it, as it can't be
+// shown again.
+func runCreateAPIToken(ctx context.Context, store Storage, args []string) error {
+	flags := flag.NewFlagSet("token create", flag.ContinueOnError)
+	name := flags.String("name", "", "name of the token holder")
+	role := flags.String("role", RoleReader, "role granted: reader, station, editor or admin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	token, err := NewAPIToken(*name, *role)
+	if err != nil {
+		return err
+	}
+	if err := store.CreateAPIToken(ctx, token); err != nil {
+		return err
+	}
+
+	return printJSON(token)
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultConfigFile is read when no config file is given and it exists.
+const defaultConfigFile = "config.yaml"
+
+// redacted replaces secrets when the configuration is printed.
+const redacted = "[REDACTED]"
+
+// Config is the configuration of the API server, its database and its
+// background jobs. Each setting is read, in increasing order of precedence,
+// from its default, the YAML config file, its env variable and its flag.
+type Config struct {
+	Log       LogConfig       `yaml:"log"`
+	Server    ServerConfig    `yaml:"server"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Stations  StationsConfig  `yaml:"stations"`
+	Forecast  ForecastConfig  `yaml:"forecast"`
+	Retention RetentionConfig `yaml:"retention"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Signing   SigningConfig   `yaml:"signing"`
+	Auth      AuthConfig      `yaml:"auth"`
+}
+
+// LogConfig configures the structured logs.
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"minimum level logged: debug, info, warn or error"`
+	Format string `yaml:"format" env:"LOG_FORMAT" flag:"log-format" usage:"log format: json or text"`
+}
+
+// ServerConfig configures the HTTP server.
+type ServerConfig struct {
+	ListenAddr        string   `yaml:"listen_addr" env:"LISTEN_ADDR" flag:"listen-addr" usage:"address the HTTP server listens on"`
+	AllowedOrigins    []string `yaml:"allowed_origins" env:"ALLOWED_ORIGINS" flag:"allowed-origins" usage:"comma-separated origins allowed by CORS"`
+	ReadTimeout       Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT" flag:"http-read-timeout" usage:"maximum duration for reading a request"`
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT" flag:"http-read-header-timeout" usage:"maximum duration for reading request headers"`
+	WriteTimeout      Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT" flag:"http-write-timeout" usage:"maximum duration for writing a response"`
+	IdleTimeout       Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT" flag:"http-idle-timeout" usage:"maximum duration a keep-alive connection stays idle"`
+	ShutdownTimeout   Duration `yaml:"shutdown_timeout" env:"HTTP_SHUTDOWN_TIMEOUT" flag:"http-shutdown-timeout" usage:"how long requests and jobs are waited for on shutdown"`
+	IdempotencyKeyTTL Duration `yaml:"idempotency_key_ttl" env:"IDEMPOTENCY_KEY_TTL" flag:"idempotency-key-ttl" usage:"how long the idempotency keys of readings are kept"`
+}
+
+// RateLimitConfig configures the request rates allowed per device and per
+// client IP, for ingestion and for reads, and the minimum interval between
+// the stored readings of a device. Rates are in requests per minute.
+type RateLimitConfig struct {
+	Enabled           bool     `yaml:"enabled" env:"RATE_LIMIT_ENABLED" flag:"rate-limit-enabled" usage:"limit the request rate of devices and clients"`
+	IngestRate        float64  `yaml:"ingest_rate" env:"RATE_LIMIT_INGEST_RATE" flag:"rate-limit-ingest-rate" usage:"ingestion requests per minute per device, 0 for unlimited"`
+	IngestBurst       int      `yaml:"ingest_burst" env:"RATE_LIMIT_INGEST_BURST" flag:"rate-limit-ingest-burst" usage:"ingestion requests a device may send at once"`
+	IngestIPRate      float64  `yaml:"ingest_ip_rate" env:"RATE_LIMIT_INGEST_IP_RATE" flag:"rate-limit-ingest-ip-rate" usage:"ingestion requests per minute per client IP, 0 for unlimited"`
+	IngestIPBurst     int      `yaml:"ingest_ip_burst" env:"RATE_LIMIT_INGEST_IP_BURST" flag:"rate-limit-ingest-ip-burst" usage:"ingestion requests a client IP may send at once"`
+	ReadRate          float64  `yaml:"read_rate" env:"RATE_LIMIT_READ_RATE" flag:"rate-limit-read-rate" usage:"read requests per minute per device, 0 for unlimited"`
+	ReadBurst         int      `yaml:"read_burst" env:"RATE_LIMIT_READ_BURST" flag:"rate-limit-read-burst" usage:"read requests a device may send at once"`
+	ReadIPRate        float64  `yaml:"read_ip_rate" env:"RATE_LIMIT_READ_IP_RATE" flag:"rate-limit-read-ip-rate" usage:"read requests per minute per client IP, 0 for unlimited"`
+	ReadIPBurst       int      `yaml:"read_ip_burst" env:"RATE_LIMIT_READ_IP_BURST" flag:"rate-limit-read-ip-burst" usage:"read requests a client IP may send at once"`
+	TrustForwardedFor bool     `yaml:"trust_forwarded_for" env:"RATE_LIMIT_TRUST_FORWARDED_FOR" flag:"rate-limit-trust-forwarded-for" usage:"take client IPs from the X-Forwarded-For header of a reverse proxy"`
+	ReadingInterval   Duration `yaml:"reading_interval" env:"RATE_LIMIT_READING_INTERVAL" flag:"rate-limit-reading-interval" usage:"minimum interval between the stored readings of a device, 0 to disable"`
+	ReadingMode       string   `yaml:"reading_mode" env:"RATE_LIMIT_READING_MODE" flag:"rate-limit-reading-mode" usage:"what happens to readings sent sooner: drop or merge"`
+}
+
+// DatabaseConfig configures the PostgreSQL connection and its pool. A DSN,
+// either a postgres:// URL or key=value pairs, replaces the discrete
+// connection options.
+type DatabaseConfig struct {
+	DSN             string   `yaml:"dsn" env:"DATABASE_URL" secret:"true"`
+	Host            string   `yaml:"host" env:"POSTGRES_DB_HOST" flag:"db-host" usage:"database host"`
+	Port            int      `yaml:"port" env:"POSTGRES_DB_PORT" flag:"db-port" usage:"database port"`
+	User            string   `yaml:"user" env:"POSTGRES_USER" flag:"db-user" usage:"database user"`
+	Password        string   `yaml:"password" env:"POSTGRES_PASSWORD" secret:"true"`
+	Name            string   `yaml:"name" env:"POSTGRES_DB_NAME" flag:"db-name" usage:"database name"`
+	SSLMode         string   `yaml:"sslmode" env:"POSTGRES_SSLMODE" flag:"db-sslmode" usage:"database sslmode"`
+	SSLRootCert     string   `yaml:"sslrootcert" env:"POSTGRES_SSLROOTCERT" flag:"db-sslrootcert" usage:"path of the CA certificate of the database server"`
+	ApplicationName string   `yaml:"application_name" env:"POSTGRES_APPLICATION_NAME" flag:"db-application-name" usage:"application name reported to the database"`
+	QueryTimeout    Duration `yaml:"query_timeout" env:"DB_QUERY_TIMEOUT" flag:"db-query-timeout" usage:"maximum duration of a single query, 0 to disable"`
+	MaxOpenConns    int      `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS" flag:"db-max-open-conns" usage:"maximum open connections, 0 for unlimited"`
+	MaxIdleConns    int      `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS" flag:"db-max-idle-conns" usage:"maximum idle connections kept in the pool"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME" flag:"db-conn-max-lifetime" usage:"maximum lifetime of a connection, 0 for unlimited"`
+	ConnMaxIdleTime Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME" flag:"db-conn-max-idle-time" usage:"maximum idle time of a connection, 0 for unlimited"`
+	ConnectTimeout  Duration `yaml:"connect_timeout" env:"DB_CONNECT_TIMEOUT" flag:"db-connect-timeout" usage:"how long the database is waited for on start"`
+}
+
+// StationsConfig configures the stale station monitor.
+type StationsConfig struct {
+	StaleAfter    Duration `yaml:"stale_after" env:"STATION_STALE_AFTER" flag:"station-stale-after" usage:"silence after which a station is stale"`
+	CheckInterval Duration `yaml:"check_interval" env:"STATION_CHECK_INTERVAL" flag:"station-check-interval" usage:"how often stations are checked"`
+	WebhookURL    string   `yaml:"webhook_url" env:"STATION_WEBHOOK_URL" secret:"true"`
+}
+
+// ForecastConfig configures the forecasting engine.
+type ForecastConfig struct {
+	Enabled      bool     `yaml:"enabled" env:"FORECAST_ENABLED" flag:"forecast-enabled" usage:"run the forecasting engine"`
+	Interval     Duration `yaml:"interval" env:"FORECAST_INTERVAL" flag:"forecast-interval" usage:"how often forecasts are generated"`
+	History      Duration `yaml:"history" env:"FORECAST_HISTORY" flag:"forecast-history" usage:"history the models are fitted on"`
+	HorizonHours int      `yaml:"horizon_hours" env:"FORECAST_HORIZON_HOURS" flag:"forecast-horizon-hours" usage:"hours predicted on each run"`
+	Models       []string `yaml:"models" env:"FORECAST_MODELS" flag:"forecast-models" usage:"comma-separated models to run"`
+}
+
+// RetentionConfig configures the default retention windows, how often
+// they are enforced and how long deleted data can be restored.
+type RetentionConfig struct {
+	RawDays            int      `yaml:"raw_days" env:"RETENTION_RAW_DAYS" flag:"retention-raw-days" usage:"default days raw readings are kept, 0 for ever"`
+	HourlyDays         int      `yaml:"hourly_days" env:"RETENTION_HOURLY_DAYS" flag:"retention-hourly-days" usage:"default days hourly aggregates are kept, 0 for ever"`
+	Interval           Duration `yaml:"interval" env:"RETENTION_INTERVAL" flag:"retention-interval" usage:"how often retention is enforced"`
+	DeletedGracePeriod Duration `yaml:"deleted_grace_period" env:"RETENTION_DELETED_GRACE_PERIOD" flag:"retention-deleted-grace-period" usage:"how long deleted data is kept before being purged, 0 for ever"`
+}
+
+// TracingConfig configures the OpenTelemetry traces of requests and queries.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER" flag:"tracing-exporter" usage:"where traces are sent: none, stdout or otlp"`
+	Endpoint    string  `yaml:"endpoint" env:"TRACING_ENDPOINT" flag:"tracing-endpoint" usage:"host:port of the OTLP/HTTP collector"`
+	Insecure    bool    `yaml:"insecure" env:"TRACING_INSECURE" flag:"tracing-insecure" usage:"send traces to the collector over plain HTTP"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" flag:"tracing-sample-ratio" usage:"share of new traces recorded, from 0 to 1"`
+	ServiceName string  `yaml:"service_name" env:"TRACING_SERVICE_NAME" flag:"tracing-service-name" usage:"service name reported in traces"`
+}
+
+// SigningConfig configures the HMAC signatures of the device requests.
+type SigningConfig struct {
+	Required bool     `yaml:"required" env:"SIGNING_REQUIRED" flag:"signing-required" usage:"require every device request changing readings to be signed"`
+	MaxSkew  Duration `yaml:"max_skew" env:"SIGNING_MAX_SKEW" flag:"signing-max-skew" usage:"how far signature timestamps may be from the server time"`
+}
+
+// AuthConfig configures the API tokens required by the routes. The admin
+// token grants the admin role without being stored, to create the first
+// tokens.
+type AuthConfig struct {
+	Enabled    bool   `yaml:"enabled" env:"AUTH_ENABLED" flag:"auth-enabled" usage:"require API tokens with a role allowed by each route"`
+	AdminToken string `yaml:"admin_token" env:"AUTH_ADMIN_TOKEN" secret:"true"`
+}
+
+// Duration is a time.Duration written as "30s" in config files.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = value
+	return nil
+}
+
+// DefaultConfig returns the configuration used for the settings which are
+// not set anywhere.
+func DefaultConfig() *Config {
+	return &Config{
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Server: ServerConfig{
+			ListenAddr:        ":3000",
+			ReadTimeout:       Duration{30 * time.Second},
+			ReadHeaderTimeout: Duration{5 * time.Second},
+			WriteTimeout:      Duration{30 * time.Second},
+			IdleTimeout:       Duration{2 * time.Minute},
+			ShutdownTimeout:   Duration{30 * time.Second},
+			IdempotencyKeyTTL: Duration{24 * time.Hour},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:       true,
+			IngestRate:    30,
+			IngestBurst:   10,
+			IngestIPRate:  120,
+			IngestIPBurst: 30,
+			ReadRate:      120,
+			ReadBurst:     60,
+			ReadIPRate:    300,
+			ReadIPBurst:   100,
+			ReadingMode:   ReadingModeDrop,
+		},
+		Database: DatabaseConfig{
+			Port:            5432,
+			SSLMode:         "require",
+			ApplicationName: "weather-api",
+			QueryTimeout:    Duration{10 * time.Second},
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: Duration{30 * time.Minute},
+			ConnMaxIdleTime: Duration{5 * time.Minute},
+			ConnectTimeout:  Duration{time.Minute},
+		},
+		Stations: StationsConfig{
+			StaleAfter:    Duration{30 * time.Minute},
+			CheckInterval: Duration{time.Minute},
+		},
+		Forecast: ForecastConfig{
+			Enabled:      true,
+			Interval:     Duration{time.Hour},
+			History:      Duration{14 * 24 * time.Hour},
+			HorizonHours: 24,
+			Models:       []string{"seasonal_naive", "holt_winters"},
+		},
+		Retention: RetentionConfig{
+			Interval:           Duration{time.Hour},
+			DeletedGracePeriod: Duration{30 * 24 * time.Hour},
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "localhost:4318",
+			SampleRatio: 1,
+			ServiceName: "weather-api",
+		},
+		Signing: SigningConfig{
+			MaxSkew: Duration{5 * time.Minute},
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the config file,
+// the environment and the flags in args, and validates it. The config file
+// is given by the -config flag or the CONFIG_FILE env variable, and
+// defaults to config.yaml when it exists. It returns the arguments left
+// after the flags.
+func LoadConfig(args []string) (*Config, []string, error) {
+	cfg := DefaultConfig()
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "path of the YAML config file")
+
+	// Flags are applied once the file and environment are loaded
+	var setters []func() error
+	err := visitConfig(cfg, func(field reflect.StructField, value reflect.Value) error {
+		name := field.Tag.Get("flag")
+		if name == "" {
+			return nil
+		}
+		set := func(s string) error {
+			setters = append(setters, func() error {
+				return setConfigValue(value, s)
+			})
+			return nil
+		}
+		if value.Kind() == reflect.Bool {
+			flags.BoolFunc(name, field.Tag.Get("usage"), set)
+		} else {
+			flags.Func(name, field.Tag.Get("usage"), set)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	path := *configFile
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		if err := loadConfigFile(cfg, path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = visitConfig(cfg, func(field reflect.StructField, value reflect.Value) error {
+		key := field.Tag.Get("env")
+		if key == "" {
+			return nil
+		}
+		if s, ok := os.LookupEnv(key); ok && s != "" {
+			if err := setConfigValue(value, s); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, set := range setters {
+		if err := set(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, flags.Args(), nil
+}
+
+// loadConfigFile reads the settings set in the YAML file over cfg. Unknown
+// settings are rejected so typos don't go unnoticed.
+func loadConfigFile(cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks the configuration, reporting every invalid setting.
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if _, err := NewLogger(cfg.Log); err != nil {
+		errs = append(errs, err)
+	}
+
+	check(cfg.Server.ListenAddr != "", "server.listen_addr is required")
+	check(cfg.Server.ReadTimeout.Duration >= 0, "server.read_timeout must not be negative")
+	check(cfg.Server.ReadHeaderTimeout.Duration >= 0, "server.read_header_timeout must not be negative")
+	check(cfg.Server.WriteTimeout.Duration >= 0, "server.write_timeout must not be negative")
+	check(cfg.Server.IdleTimeout.Duration >= 0, "server.idle_timeout must not be negative")
+	check(cfg.Server.ShutdownTimeout.Duration > 0, "server.shutdown_timeout must be positive")
+	check(cfg.Server.IdempotencyKeyTTL.Duration > 0, "server.idempotency_key_ttl must be positive")
+
+	if cfg.RateLimit.Enabled {
+		limits := []struct {
+			name  string
+			rate  float64
+			burst int
+		}{
+			{"ingest", cfg.RateLimit.IngestRate, cfg.RateLimit.IngestBurst},
+			{"ingest_ip", cfg.RateLimit.IngestIPRate, cfg.RateLimit.IngestIPBurst},
+			{"read", cfg.RateLimit.ReadRate, cfg.RateLimit.ReadBurst},
+			{"read_ip", cfg.RateLimit.ReadIPRate, cfg.RateLimit.ReadIPBurst},
+		}
+		for _, limit := range limits {
+			check(limit.rate >= 0, "rate_limit.%s_rate must not be negative", limit.name)
+			check(limit.rate == 0 || limit.burst >= 1, "rate_limit.%s_burst must be at least 1", limit.name)
+		}
+		check(cfg.RateLimit.ReadingInterval.Duration >= 0, "rate_limit.reading_interval must not be negative")
+		switch cfg.RateLimit.ReadingMode {
+		case ReadingModeDrop, ReadingModeMerge:
+		default:
+			errs = append(errs, fmt.Errorf("rate_limit.reading_mode must be drop or merge"))
+		}
+	}
+
+	if cfg.Database.DSN == "" {
+		check(cfg.Database.Host != "", "database.host is required")
+		check(cfg.Database.Port > 0 && cfg.Database.Port < 65536, "database.port must be between 1 and 65535")
+		check(cfg.Database.User != "", "database.user is required")
+		check(cfg.Database.Name != "", "database.name is required")
+		switch cfg.Database.SSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			errs = append(errs, fmt.Errorf("database.sslmode must be one of disable, allow, prefer, require, verify-ca, verify-full"))
+		}
+	}
+	check(cfg.Database.QueryTimeout.Duration >= 0, "database.query_timeout must not be negative")
+	check(cfg.Database.MaxOpenConns >= 0, "database.max_open_conns must not be negative")
+	check(cfg.Database.MaxIdleConns >= 0, "database.max_idle_conns must not be negative")
+	check(cfg.Database.MaxOpenConns == 0 || cfg.Database.MaxIdleConns <= cfg.Database.MaxOpenConns, "database.max_idle_conns must not exceed database.max_open_conns")
+	check(cfg.Database.ConnMaxLifetime.Duration >= 0, "database.conn_max_lifetime must not be negative")
+	check(cfg.Database.ConnMaxIdleTime.Duration >= 0, "database.conn_max_idle_time must not be negative")
+	check(cfg.Database.ConnectTimeout.Duration > 0, "database.connect_timeout must be positive")
+
+	check(cfg.Stations.StaleAfter.Duration > 0, "stations.stale_after must be positive")
+	check(cfg.Stations.CheckInterval.Duration > 0, "stations.check_interval must be positive")
+
+	if cfg.Forecast.Enabled {
+		check(cfg.Forecast.Interval.Duration > 0, "forecast.interval must be positive")
+		check(cfg.Forecast.History.Duration > 0, "forecast.history must be positive")
+		check(cfg.Forecast.HorizonHours > 0, "forecast.horizon_hours must be positive")
+		if _, err := forecastModelsByName(cfg.Forecast.Models); err != nil {
+			errs = append(errs, fmt.Errorf("forecast.models: %v", err))
+		}
+	}
+
+	check(cfg.Retention.Interval.Duration > 0, "retention.interval must be positive")
+	check(cfg.Retention.DeletedGracePeriod.Duration >= 0, "retention.deleted_grace_period must not be negative")
+	if _, err := NewRetentionPolicy("", cfg.Retention.RawDays, cfg.Retention.HourlyDays); err != nil {
+		errs = append(errs, fmt.Errorf("retention: %v", err))
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter must be one of none, stdout, otlp"))
+	}
+	check(cfg.Tracing.Exporter != "otlp" || cfg.Tracing.Endpoint != "", "tracing.endpoint is required with the otlp exporter")
+	check(cfg.Tracing.SampleRatio >= 0 && cfg.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	check(cfg.Tracing.ServiceName != "", "tracing.service_name is required")
+
+	check(cfg.Signing.MaxSkew.Duration > 0, "signing.max_skew must be positive")
+
+	check(cfg.Auth.AdminToken == "" || len(cfg.Auth.AdminToken) >= minAdminTokenLength, "auth.admin_token must be at least %d characters", minAdminTokenLength)
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the configuration with the secrets replaced,
+// for printing.
+func (cfg *Config) Redacted() *Config {
+	copied := *cfg
+	_ = visitConfig(&copied, func(field reflect.StructField, value reflect.Value) error {
+		if field.Tag.Get("secret") == "true" && value.String() != "" {
+			value.SetString(redacted)
+		}
+		return nil
+	})
+	return &copied
+}
+
+// visitConfig calls fn with every setting of cfg.
+func visitConfig(cfg *Config, fn func(field reflect.StructField, value reflect.Value) error) error {
+	sections := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			if err := fn(section.Type().Field(j), section.Field(j)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setConfigValue parses s into the setting value.
+func setConfigValue(value reflect.Value, s string) error {
+	switch value.Interface().(type) {
+	case string:
+		value.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q must be a number", s)
+		}
+		value.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%q must be a number", s)
+		}
+		value.SetFloat(f)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q must be true or false", s)
+		}
+		value.SetBool(b)
+	case Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q must be a duration", s)
+		}
+		value.Set(reflect.ValueOf(Duration{d}))
+	case []string:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
@@ -1,37 +1,110 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"os"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func NewPostgresStore() (*PostgresStore, error) {
-	user := os.Getenv("POSTGRES_USER")
-	password := os.Getenv("POSTGRES_PASSWORD")
-	dbname := os.Getenv("POSTGRES_DB_NAME")
-	endpoint := os.Getenv("POSTGRES_DB_HOST")
-
-	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=require", user, password, dbname, endpoint)
+// Initial and maximum wait between attempts to reach the database on start.
+const (
+	connectBackoffMin = 500 * time.Millisecond
+	connectBackoffMax = 10 * time.Second
+)
 
-	db, err := sql.Open("postgres", connStr)
+func NewPostgresStore(ctx context.Context, cfg DatabaseConfig) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", cfg.ConnectionString())
 	if err != nil {
 		return nil, err
 	}
 
+	// Keep bursts of requests from exhausting the server connections
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime.Duration)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime.Duration)
+
 	// Ping the database to verify connectivity
-	if err := db.Ping(); err != nil {
+	if err := pingWithBackoff(ctx, db, cfg.ConnectTimeout.Duration); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	// Install UUID on postgres
-	_, err = db.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\";")
+	_, err = db.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\";")
 	if err != nil {
-		fmt.Println("Error creating uuid-ossp extension:", err)
+		slog.ErrorContext(ctx, "creating uuid-ossp extension", "error", err)
+		db.Close()
 		return nil, err
 	}
 
 	return &PostgresStore{
-		db: db,
+		db:           &tracedDB{db},
+		queryTimeout: cfg.QueryTimeout.Duration,
 	}, nil
 }
+
+// ConnectionString returns the DSN when set, or the key=value connection
+// string built from the discrete options otherwise.
+func (cfg DatabaseConfig) ConnectionString() string {
+	if cfg.DSN != "" {
+		return cfg.DSN
+	}
+
+	options := []struct{ key, value string }{
+		{"host", cfg.Host},
+		{"port", strconv.Itoa(cfg.Port)},
+		{"user", cfg.User},
+		{"password", cfg.Password},
+		{"dbname", cfg.Name},
+		{"sslmode", cfg.SSLMode},
+		{"sslrootcert", cfg.SSLRootCert},
+		{"application_name", cfg.ApplicationName},
+	}
+
+	var pairs []string
+	for _, option := range options {
+		if option.value == "" {
+			continue
+		}
+		pairs = append(pairs, option.key+"="+quoteConnValue(option.value))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// quoteConnValue quotes a connection string value so it may contain spaces,
+// quotes and backslashes.
+func quoteConnValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// pingWithBackoff pings the database until it answers, waiting twice as
+// long after each failed attempt, so the API may start before the database.
+// It gives up after timeout or once ctx is done.
+func pingWithBackoff(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := connectBackoffMin
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+
+		slog.WarnContext(ctx, "database not reachable", "attempt", attempt, "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database not reachable after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, connectBackoffMax)
+	}
+}
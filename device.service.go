@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func (server *APIServer) handleCreateDevice(w http.ResponseWriter, r *http.Request) error {
+	req := new(CreateDeviceRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+
+	device, err := NewDevice(req.ID)
+	if err != nil {
+		return err
+	}
+
+	err = server.store.CreateDevice(r.Context(), device)
+	if err != nil {
+		return err
+	}
+
+	// The secret is only ever returned here and on rotation
+	return WriteJSON(w, http.StatusOK, device)
+}
+
+func (server *APIServer) handleGetDevices(w http.ResponseWriter, r *http.Request) error {
+	devices, err := server.store.GetDevices(r.Context())
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		device.Secret = ""
+	}
+
+	return WriteJSON(w, http.StatusOK, devices)
+}
+
+func (server *APIServer) handleGetDeviceByID(w http.ResponseWriter, r *http.Request) error {
+	device, err := server.store.GetDeviceByID(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	device.Secret = ""
+
+	return WriteJSON(w, http.StatusOK, device)
+}
+
+func (server *APIServer) handleRotateDeviceSecret(w http.ResponseWriter, r *http.Request) error {
+	secret, err := newDeviceSecret()
+	if err != nil {
+		return err
+	}
+
+	device := &Device{ID: mux.Vars(r)["id"], Secret: secret}
+	if err := server.store.UpdateDeviceSecret(r.Context(), device); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, device)
+}
+
+func (server *APIServer) handleDeleteDevice(w http.ResponseWriter, r *http.Request) error {
+	id := mux.Vars(r)["id"]
+
+	err := server.store.DeleteDevice(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": id})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers carrying the signature of a device request.
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+)
+
+// maxSignedBodyBytes bounds the bodies read to check their signature.
+const maxSignedBodyBytes = 64 << 10
+
+// Bounds of the nonces accepted from devices.
+const (
+	minNonceLength = 8
+	maxNonceLength = 128
+)
+
+// SignatureVerifier checks the HMAC-SHA256 signatures devices compute over
+// their requests with their secret, so that stations without TLS can't be
+// impersonated or replayed.
+type SignatureVerifier struct {
+	store    Storage
+	required bool
+	maxSkew  time.Duration
+}
+
+// NewSignatureVerifier creates a new instance of SignatureVerifier.
+func NewSignatureVerifier(store Storage, cfg SigningConfig) *SignatureVerifier {
+	return &SignatureVerifier{
+		store:    store,
+		required: cfg.Required,
+		maxSkew:  cfg.MaxSkew.Duration,
+	}
+}
+
+// SignRequest returns the hex HMAC-SHA256, keyed by the device secret, of
+// the method, path, timestamp, nonce and body of a request, one per line.
+func SignRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n", method, path, timestamp, nonce)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignatures is a middleware which rejects the requests changing
+// data which are not signed by their device with
+// http.StatusUnauthorized. Registered devices must always sign, and any
+// device must when signatures are required. Unsigned requests of unknown
+// devices are let through otherwise, as are the requests authenticated by
+// an API token of a role other than station, which don't come from
+// devices. Requests without an API token are then made by the device whose
+// signature was verified.
+func (v *SignatureVerifier) verifySignatures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if principal, ok := PrincipalFromContext(r.Context()); ok && principal.Role != RoleStation {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		device, err := v.verify(r)
+		if err != nil {
+			status := http.StatusUnauthorized
+			var verifyErr *signatureError
+			if !errors.As(err, &verifyErr) {
+				status = errorStatus(err)
+			}
+			writeAPIError(w, r, status, err.Error())
+			return
+		}
+
+		if _, ok := PrincipalFromContext(r.Context()); !ok && device != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, devicePrincipal(device.ID)))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signatureError is the reason a request signature was refused.
+type signatureError struct {
+	reason string
+}
+
+func (e *signatureError) Error() string {
+	return e.reason
+}
+
+func refuseSignature(format string, args ...any) error {
+	return &signatureError{reason: fmt.Sprintf(format, args...)}
+}
+
+// verify checks the signature of r, leaving its body to be read again. It
+// returns the device which signed r, or nil when r is unsigned and needs
+// not be.
+func (v *SignatureVerifier) verify(r *http.Request) (*Device, error) {
+	ctx := r.Context()
+	deviceID := r.Header.Get(deviceIDHeader)
+	signature := strings.ToLower(r.Header.Get(signatureHeader))
+	signed := signature != ""
+
+	if deviceID == "" {
+		if v.required || signed {
+			return nil, refuseSignature("%s is required for signed requests", deviceIDHeader)
+		}
+		return nil, nil
+	}
+
+	device, err := v.store.GetDeviceByID(ctx, deviceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if v.required || signed {
+			return nil, refuseSignature("unknown device %q", deviceID)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	nonce := r.Header.Get(signatureNonceHeader)
+	if !signed || timestamp == "" || nonce == "" {
+		return nil, refuseSignature("device %q must sign its requests with %s, %s and %s", deviceID, signatureHeader, signatureTimestampHeader, signatureNonceHeader)
+	}
+
+	// The timestamp bounds how long nonces must be remembered
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, refuseSignature("%s must be a Unix time in seconds", signatureTimestampHeader)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > v.maxSkew || skew < -v.maxSkew {
+		return nil, refuseSignature("stale signature timestamp")
+	}
+
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength || !validRequestID(nonce) {
+		return nil, refuseSignature("%s must be %d to %d printable characters", signatureNonceHeader, minNonceLength, maxNonceLength)
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := SignRequest(device.Secret, r.Method, r.URL.Path, timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, refuseSignature("invalid signature")
+	}
+
+	// Nonces are only recorded once the signature holds, so that others
+	// can't use them up
+	fresh, err := v.store.UseDeviceNonce(ctx, device.ID, nonce, signedAt.Add(v.maxSkew).UTC())
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, refuseSignature("replayed nonce")
+	}
+
+	return device, nil
+}
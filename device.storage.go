@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+func (s *PostgresStore) CreateDeviceTables(ctx context.Context) error {
+	// Secrets are kept as is since the server signs with them too
+	_, err := s.db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS devices (
+            id TEXT PRIMARY KEY,
+            secret TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP NULL
+        );
+
+        CREATE TABLE IF NOT EXISTS device_nonces (
+            device_id TEXT NOT NULL,
+            nonce TEXT NOT NULL,
+            expires_at TIMESTAMP NOT NULL,
+            PRIMARY KEY (device_id, nonce),
+            FOREIGN KEY (device_id) REFERENCES devices(id) ON DELETE CASCADE
+        );
+
+        CREATE INDEX IF NOT EXISTS device_nonces_expires_at_idx ON device_nonces (expires_at);
+    `)
+	return err
+}
+
+func (s *PostgresStore) CreateDevice(ctx context.Context, device *Device) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO devices (id, secret) 
+		VALUES ($1, $2)
+		RETURNING created_at
+	`
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		return tx.QueryRowContext(ctx, query, device.ID, device.Secret).Scan(&device.CreatedAt)
+	})
+}
+
+func (s *PostgresStore) GetDevices(ctx context.Context) ([]*Device, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, secret, created_at, updated_at 
+		FROM devices 
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var devices []*Device
+	for rows.Next() {
+		device, err := scanIntoDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// GetDeviceByID returns the device with its secret. The error of an
+// unknown device wraps sql.ErrNoRows.
+func (s *PostgresStore) GetDeviceByID(ctx context.Context, id string) (*Device, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, secret, created_at, updated_at 
+		FROM devices 
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		return scanIntoDevice(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("device [%s] not found: %w", id, sql.ErrNoRows)
+}
+
+func scanIntoDevice(rows *tracedRows) (*Device, error) {
+	device := new(Device)
+	err := rows.Scan(
+		&device.ID,
+		&device.Secret,
+		&device.CreatedAt,
+		&device.UpdatedAt,
+	)
+
+	return device, err
+}
+
+// UpdateDeviceSecret replaces the secret of the device.
+func (s *PostgresStore) UpdateDeviceSecret(ctx context.Context, device *Device) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE devices 
+		SET secret = $1, updated_at = NOW() 
+		WHERE id = $2
+		RETURNING created_at, updated_at
+	`
+
+	err := s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		return tx.QueryRowContext(ctx, query, device.Secret, device.ID).Scan(&device.CreatedAt, &device.UpdatedAt)
+	})
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("device [%s] not found", device.ID)
+	}
+	return err
+}
+
+func (s *PostgresStore) DeleteDevice(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		DELETE FROM devices 
+		WHERE id = $1
+	`
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		_, err := tx.ExecContext(ctx, query, id)
+		return err
+	})
+}
+
+// UseDeviceNonce records the nonce of a signed request of the device until
+// expiresAt. It returns false when the nonce was used already.
+func (s *PostgresStore) UseDeviceNonce(ctx context.Context, deviceID, nonce string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO device_nonces (device_id, nonce, expires_at) 
+		VALUES ($1, $2, $3)
+		ON CONFLICT (device_id, nonce) DO NOTHING
+	`, deviceID, nonce, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return inserted == 1, nil
+}
+
+// DeleteExpiredDeviceNonces deletes the nonces expired at now, which can't
+// be replayed anymore as their timestamp is too old, and returns how many
+// were deleted.
+func (s *PostgresStore) DeleteExpiredDeviceNonces(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM device_nonces 
+		WHERE expires_at <= $1
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
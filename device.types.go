@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// deviceSecretBytes is the size of the generated device secrets.
+const deviceSecretBytes = 32
+
+// Device is a station allowed to sign its requests with Secret, shared
+// with the server. The secret is only returned when it is generated.
+type Device struct {
+	ID        string     `json:"id"`
+	Secret    string     `json:"secret,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type CreateDeviceRequest struct {
+	ID string `json:"id"`
+}
+
+// NewDevice creates the device sending the given X-Device-ID with a new
+// secret.
+func NewDevice(id string) (*Device, error) {
+	if !validRequestID(id) {
+		return nil, fmt.Errorf("device id must be 1 to %d printable characters without spaces", maxRequestIDLength)
+	}
+
+	secret, err := newDeviceSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Device{
+		ID:     id,
+		Secret: secret,
+	}, nil
+}
+
+// newDeviceSecret generates a random secret, hex encoded.
+func newDeviceSecret() (string, error) {
+	secret := make([]byte, deviceSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/parquet-go/parquet-go"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats accepted in the format query parameter.
+const (
+	ExportJSON    = "json"
+	ExportCSV     = "csv"
+	ExportNDJSON  = "ndjson"
+	ExportParquet = "parquet"
+)
+
+// exportContentTypes maps each export format to its media type.
+var exportContentTypes = map[string]string{
+	ExportJSON:    "application/json; charset=utf-8",
+	ExportCSV:     "text/csv; charset=utf-8",
+	ExportNDJSON:  "application/x-ndjson",
+	ExportParquet: "application/vnd.apache.parquet",
+}
+
+// exportFlushEvery is the number of rows buffered before CSV and NDJSON
+// output is flushed to the client, so that large exports are streamed
+// rather than held in the buffers of the response.
+const exportFlushEvery = 1000
+
+// exportRowGroupSize bounds the rows a Parquet export keeps in memory
+// before writing them out as a row group.
+const exportRowGroupSize = 10000
+
+// getExportFormat returns the format requested through the format query
+// parameter or, when it is missing, the Accept header. JSON is the default.
+func getExportFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := exportContentTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported format: %s", format)
+		}
+		return format, nil
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return ExportCSV, nil
+		case "application/x-ndjson", "application/jsonl":
+			return ExportNDJSON, nil
+		case "application/vnd.apache.parquet", "application/x-parquet":
+			return ExportParquet, nil
+		}
+	}
+
+	return ExportJSON, nil
+}
+
+// exportRow is a record that can be written by every exporter.
+type exportRow interface {
+	csvHeader() []string
+	csvRecord() []string
+	parquetRow() any
+}
+
+// exporter writes rows in a given format.
+type exporter interface {
+	Write(row exportRow) error
+	Close() error
+}
+
+// exportStream streams rows to the HTTP response. The response headers are
+// only written with the first row, so an error raised before that can
+// still be reported as a regular JSON error.
+type exportStream struct {
+	w       http.ResponseWriter
+	format  string
+	name    string
+	sample  exportRow
+	encoder exporter
+}
+
+// newExportStream creates an export of the rows named name in the given
+// format. sample is only used to derive the CSV header and Parquet schema,
+// so it may be a zero value.
+func newExportStream(w http.ResponseWriter, format, name string, sample exportRow) (*exportStream, error) {
+	if _, ok := exportContentTypes[format]; !ok || format == ExportJSON {
+		return nil, fmt.Errorf("unsupported export format: %s", format)
+	}
+
+	// Exports may take longer than the server write timeout allows
+	if err := clearDeadlines(w); err != nil {
+		return nil, err
+	}
+
+	return &exportStream{w: w, format: format, name: name, sample: sample}, nil
+}
+
+// Started reports whether the response has been sent to the client.
+func (s *exportStream) Started() bool {
+	return s.encoder != nil
+}
+
+func (s *exportStream) start() {
+	switch s.format {
+	case ExportCSV:
+		s.encoder = &csvExporter{w: csv.NewWriter(s.w), rc: http.NewResponseController(s.w), header: s.sample.csvHeader()}
+	case ExportNDJSON:
+		s.encoder = &ndjsonExporter{rc: http.NewResponseController(s.w), encoder: json.NewEncoder(s.w)}
+	case ExportParquet:
+		s.encoder = &parquetExporter{w: parquet.NewWriter(s.w, parquet.SchemaOf(s.sample.parquetRow()), parquet.MaxRowsPerRowGroup(exportRowGroupSize))}
+	}
+
+	s.w.Header().Set("Content-Type", exportContentTypes[s.format])
+	s.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.name+"."+s.format))
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// Write sends a row to the client.
+func (s *exportStream) Write(row exportRow) error {
+	if !s.Started() {
+		s.start()
+	}
+	return s.encoder.Write(row)
+}
+
+// Close completes the export, sending the headers of an empty one.
+func (s *exportStream) Close() error {
+	if !s.Started() {
+		s.start()
+	}
+	return s.encoder.Close()
+}
+
+type csvExporter struct {
+	w      *csv.Writer
+	rc     *http.ResponseController
+	header []string
+	rows   int
+}
+
+func (e *csvExporter) Write(row exportRow) error {
+	if e.rows == 0 {
+		if err := e.w.Write(e.header); err != nil {
+			return err
+		}
+	}
+	if err := e.w.Write(row.csvRecord()); err != nil {
+		return err
+	}
+
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		e.w.Flush()
+		if err := e.w.Error(); err != nil {
+			return err
+		}
+		return flushResponse(e.rc)
+	}
+	return nil
+}
+
+func (e *csvExporter) Close() error {
+	// An empty export still gets its header
+	if e.rows == 0 {
+		if err := e.w.Write(e.header); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExporter struct {
+	rc      *http.ResponseController
+	encoder *json.Encoder
+	rows    int
+}
+
+func (e *ndjsonExporter) Write(row exportRow) error {
+	if err := e.encoder.Encode(row); err != nil {
+		return err
+	}
+
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		return flushResponse(e.rc)
+	}
+	return nil
+}
+
+func (e *ndjsonExporter) Close() error {
+	return nil
+}
+
+// flushResponse sends the response written so far to the client, when the
+// connection allows it.
+func flushResponse(rc *http.ResponseController) error {
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+type parquetExporter struct {
+	w *parquet.Writer
+}
+
+func (e *parquetExporter) Write(row exportRow) error {
+	return e.w.Write(row.parquetRow())
+}
+
+func (e *parquetExporter) Close() error {
+	return e.w.Close()
+}
+
+// formatFloat formats v for CSV output without losing precision.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// formatOptionalTime formats t as RFC 3339 for CSV output, empty when nil.
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (weather *Weather) csvHeader() []string {
+	return []string{"id", "temperature", "humidity", "city_id", "created_at", "updated_at"}
+}
+
+func (weather *Weather) csvRecord() []string {
+	return []string{
+		weather.ID,
+		formatFloat(weather.Temperature),
+		formatFloat(weather.Humidity),
+		weather.CityID,
+		weather.CreatedAt.Format(time.RFC3339),
+		formatOptionalTime(weather.UpdatedAt),
+	}
+}
+
+type weatherParquetRow struct {
+	ID          string     `parquet:"id"`
+	Temperature float64    `parquet:"temperature"`
+	Humidity    float64    `parquet:"humidity"`
+	CityID      string     `parquet:"city_id"`
+	CreatedAt   time.Time  `parquet:"created_at"`
+	UpdatedAt   *time.Time `parquet:"updated_at,optional"`
+}
+
+func (weather *Weather) parquetRow() any {
+	return &weatherParquetRow{
+		ID:          weather.ID,
+		Temperature: weather.Temperature,
+		Humidity:    weather.Humidity,
+		CityID:      weather.CityID,
+		CreatedAt:   weather.CreatedAt,
+		UpdatedAt:   weather.UpdatedAt,
+	}
+}
+
+func (average *HourlyAverage) csvHeader() []string {
+	return []string{"hour", "temperature", "humidity"}
+}
+
+func (average *HourlyAverage) csvRecord() []string {
+	return []string{
+		average.Hour.Format(time.RFC3339),
+		formatFloat(average.Temperature),
+		formatFloat(average.Humidity),
+	}
+}
+
+type hourlyAverageParquetRow struct {
+	Hour        time.Time `parquet:"hour"`
+	Temperature float64   `parquet:"temperature"`
+	Humidity    float64   `parquet:"humidity"`
+}
+
+func (average *HourlyAverage) parquetRow() any {
+	return &hourlyAverageParquetRow{
+		Hour:        average.Hour,
+		Temperature: average.Temperature,
+		Humidity:    average.Humidity,
+	}
+}
+
+func (prediction *Prediction) csvHeader() []string {
+	return []string{
+		"id", "city_id", "temperature", "humidity", "forecast_for", "created_at", "updated_at",
+		"source", "model", "issued_at", "lead_time_hours",
+	}
+}
+
+func (prediction *Prediction) csvRecord() []string {
+	model := ""
+	if prediction.Model != nil {
+		model = *prediction.Model
+	}
+
+	return []string{
+		prediction.ID,
+		prediction.CityID,
+		formatFloat(prediction.Temperature),
+		formatFloat(prediction.Humidity),
+		prediction.ForecastFor.Format(time.RFC3339),
+		prediction.CreatedAt.Format(time.RFC3339),
+		formatOptionalTime(prediction.UpdatedAt),
+		prediction.Source,
+		model,
+		prediction.IssuedAt.Format(time.RFC3339),
+		formatFloat(prediction.LeadTimeHours),
+	}
+}
+
+type predictionParquetRow struct {
+	ID            string     `parquet:"id"`
+	CityID        string     `parquet:"city_id"`
+	Temperature   float64    `parquet:"temperature"`
+	Humidity      float64    `parquet:"humidity"`
+	ForecastFor   time.Time  `parquet:"forecast_for"`
+	CreatedAt     time.Time  `parquet:"created_at"`
+	UpdatedAt     *time.Time `parquet:"updated_at,optional"`
+	Source        string     `parquet:"source"`
+	Model         *string    `parquet:"model,optional"`
+	IssuedAt      time.Time  `parquet:"issued_at"`
+	LeadTimeHours float64    `parquet:"lead_time_hours"`
+}
+
+func (prediction *Prediction) parquetRow() any {
+	return &predictionParquetRow{
+		ID:            prediction.ID,
+		CityID:        prediction.CityID,
+		Temperature:   prediction.Temperature,
+		Humidity:      prediction.Humidity,
+		ForecastFor:   prediction.ForecastFor,
+		CreatedAt:     prediction.CreatedAt,
+		UpdatedAt:     prediction.UpdatedAt,
+		Source:        prediction.Source,
+		Model:         prediction.Model,
+		IssuedAt:      prediction.IssuedAt,
+		LeadTimeHours: prediction.LeadTimeHours,
+	}
+}
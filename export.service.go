@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (server *APIServer) handleExportWeathers(w http.ResponseWriter, r *http.Request, format string) error {
+	cityID := r.URL.Query().Get("city_id")
+	hourlyAverage := r.URL.Query().Get("hourly_average") == "true"
+	getLast := r.URL.Query().Get("get_last")
+
+	var last int
+	if getLast != "" {
+		var err error
+		last, err = strconv.Atoi(getLast)
+		if err != nil {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "get_last must be a number"})
+		}
+	}
+
+	if hourlyAverage {
+		if cityID == "" {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "city_id is required for hourly averages"})
+		}
+
+		stream, err := newExportStream(w, format, "hourly_averages", &HourlyAverage{})
+		if err != nil {
+			return err
+		}
+
+		err = server.store.StreamHourlyAveragesByCityID(r.Context(), cityID, last, func(average *HourlyAverage) error {
+			return stream.Write(average)
+		})
+		return finishExport(r.Context(), stream, err)
+	}
+
+	q := WeatherQuery{CityID: cityID}
+	if getLast != "" {
+		since := time.Now().UTC().Add(-time.Duration(last) * time.Hour)
+		q.Since = &since
+	}
+
+	stream, err := newExportStream(w, format, "weather", &Weather{})
+	if err != nil {
+		return err
+	}
+
+	err = server.store.StreamWeathers(r.Context(), q, func(weather *Weather) error {
+		return stream.Write(weather)
+	})
+	return finishExport(r.Context(), stream, err)
+}
+
+func (server *APIServer) handleExportPredictions(w http.ResponseWriter, r *http.Request, cityID string, query PredictionQuery, format string) error {
+	stream, err := newExportStream(w, format, "predictions", &Prediction{})
+	if err != nil {
+		return err
+	}
+
+	err = server.store.StreamPredictionsByCityID(r.Context(), cityID, query, func(prediction *Prediction) error {
+		return stream.Write(prediction)
+	})
+	return finishExport(r.Context(), stream, err)
+}
+
+// finishExport closes the stream after a successful export. Once rows have
+// been sent an error can no longer be reported as JSON, so the connection
+// is aborted instead for the client to see a truncated download.
+func finishExport(ctx context.Context, stream *exportStream, err error) error {
+	if err == nil {
+		err = stream.Close()
+	}
+	if err == nil || !stream.Started() {
+		return err
+	}
+
+	slog.ErrorContext(ctx, "export failed after the response started", "error", err)
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// ForecastModel produces the next horizon values of an evenly spaced series.
+type ForecastModel interface {
+	Name() string
+	Forecast(series []float64, horizon int) ([]float64, error)
+}
+
+// SeasonalNaive repeats the values observed one season ago.
+type SeasonalNaive struct {
+	Season int
+}
+
+// Name returns the identifier stored with the predictions of this model.
+func (m SeasonalNaive) Name() string {
+	return "seasonal_naive"
+}
+
+// Forecast returns the last observed season repeated over the horizon.
+func (m SeasonalNaive) Forecast(series []float64, horizon int) ([]float64, error) {
+	if len(series) < m.Season {
+		return nil, fmt.Errorf("%s needs at least %d values, got %d", m.Name(), m.Season, len(series))
+	}
+
+	lastSeason := series[len(series)-m.Season:]
+	forecast := make([]float64, horizon)
+	for h := range forecast {
+		forecast[h] = lastSeason[h%m.Season]
+	}
+	return forecast, nil
+}
+
+// HoltWinters is additive triple exponential smoothing. The smoothing
+// parameters are picked by a grid search minimizing the one-step-ahead
+// squared error over the series.
+type HoltWinters struct {
+	Season int
+}
+
+// holtWintersGrid holds the candidate values tried for alpha, beta and gamma.
+var holtWintersGrid = []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.7, 0.9}
+
+// Name returns the identifier stored with the predictions of this model.
+func (m HoltWinters) Name() string {
+	return "holt_winters"
+}
+
+// Forecast fits the model on the series and extrapolates it over the horizon.
+func (m HoltWinters) Forecast(series []float64, horizon int) ([]float64, error) {
+	if len(series) < 2*m.Season {
+		return nil, fmt.Errorf("%s needs at least %d values, got %d", m.Name(), 2*m.Season, len(series))
+	}
+
+	bestSSE := math.Inf(1)
+	var best []float64
+	for _, alpha := range holtWintersGrid {
+		for _, beta := range holtWintersGrid {
+			for _, gamma := range holtWintersGrid {
+				forecast, sse := holtWinters(series, m.Season, horizon, alpha, beta, gamma)
+				if sse < bestSSE {
+					bestSSE = sse
+					best = forecast
+				}
+			}
+		}
+	}
+
+	return best, nil
+}
+
+// holtWinters runs additive Holt-Winters with the given parameters and
+// returns the forecast together with the in-sample one-step squared error.
+func holtWinters(series []float64, season, horizon int, alpha, beta, gamma float64) ([]float64, float64) {
+	level := mean(series[:season])
+	trend := (mean(series[season:2*season]) - level) / float64(season)
+
+	seasonals := make([]float64, season)
+	for i := range seasonals {
+		seasonals[i] = series[i] - level
+	}
+
+	var sse float64
+	for t := season; t < len(series); t++ {
+		s := seasonals[t%season]
+		errStep := series[t] - (level + trend + s)
+		sse += errStep * errStep
+
+		newLevel := alpha*(series[t]-s) + (1-alpha)*(level+trend)
+		trend = beta*(newLevel-level) + (1-beta)*trend
+		seasonals[t%season] = gamma*(series[t]-newLevel) + (1-gamma)*s
+		level = newLevel
+	}
+
+	n := len(series)
+	forecast := make([]float64, horizon)
+	for h := 1; h <= horizon; h++ {
+		forecast[h-1] = level + float64(h)*trend + seasonals[(n-1+h)%season]
+	}
+
+	return forecast, sse
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Forecaster periodically generates short-term predictions for every city
+// from its stored hourly weather history.
+type Forecaster struct {
+	store    Storage
+	models   []ForecastModel
+	interval time.Duration
+	horizon  int
+	history  time.Duration
+}
+
+// NewForecaster creates a new instance of Forecaster. horizon is the number
+// of hourly steps predicted on each run.
+func NewForecaster(store Storage, models []ForecastModel, interval time.Duration, horizon int, history time.Duration) *Forecaster {
+	return &Forecaster{
+		store:    store,
+		models:   models,
+		interval: interval,
+		horizon:  horizon,
+		history:  history,
+	}
+}
+
+// forecastModelsByName returns the models selected by name. The daily
+// cycle of the hourly series is used as season.
+func forecastModelsByName(names []string) ([]ForecastModel, error) {
+	var models []ForecastModel
+	for _, name := range names {
+		switch name {
+		case "seasonal_naive":
+			models = append(models, SeasonalNaive{Season: 24})
+		case "holt_winters":
+			models = append(models, HoltWinters{Season: 24})
+		default:
+			return nil, fmt.Errorf("unknown forecast model: %s", name)
+		}
+	}
+	return models, nil
+}
+
+// Run generates forecasts on each interval tick until ctx is done.
+func (f *Forecaster) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		// Let a run in progress finish on shutdown
+		if err := f.RunOnce(context.WithoutCancel(ctx)); err != nil {
+			slog.ErrorContext(ctx, "forecaster run", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce generates forecasts for every city. A city that cannot be
+// forecast does not stop the others.
+func (f *Forecaster) RunOnce(ctx context.Context) error {
+	cities, err := f.store.GetCities(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, city := range cities {
+		if err := f.forecastCity(ctx, city); err != nil {
+			slog.WarnContext(ctx, "forecasting city", "city_id", city.ID, "city", city.Name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+func (f *Forecaster) forecastCity(ctx context.Context, city *City) error {
+	now := time.Now().UTC()
+	history, err := f.store.GetHourlySeriesByCityID(ctx, city.ID, now.Add(-f.history))
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		return nil
+	}
+
+	last := history[len(history)-1].Hour
+	if now.Sub(last) > 24*time.Hour {
+		return fmt.Errorf("no readings since %s, skipping", last.Format(time.RFC3339))
+	}
+
+	temperatures, humidities := fillHourlyGaps(history)
+
+	// A model lacking history doesn't keep the others from being saved
+	var predictions []*Prediction
+	for _, model := range f.models {
+		name := model.Name()
+		temperatureForecast, err := model.Forecast(temperatures, f.horizon)
+		if err != nil {
+			slog.ErrorContext(ctx, "forecasting model", "model", name, "city_id", city.ID, "city", city.Name, "error", err)
+			continue
+		}
+		humidityForecast, err := model.Forecast(humidities, f.horizon)
+		if err != nil {
+			slog.ErrorContext(ctx, "forecasting model", "model", name, "city_id", city.ID, "city", city.Name, "error", err)
+			continue
+		}
+
+		for h := 0; h < f.horizon; h++ {
+			forecastFor := last.Add(time.Duration(h+1) * time.Hour)
+			if !forecastFor.After(now) {
+				continue
+			}
+
+			prediction, err := NewPrediction(
+				city.ID,
+				temperatureForecast[h],
+				math.Min(math.Max(humidityForecast[h], 0), 100),
+				forecastFor,
+				PredictionSourceEngine,
+				&name,
+				&now,
+			)
+			if err != nil {
+				return err
+			}
+
+			predictions = append(predictions, prediction)
+		}
+	}
+
+	if len(predictions) == 0 {
+		return nil
+	}
+
+	// Store the run of every model at once
+	_, err = f.store.CreatePredictions(ctx, predictions)
+	return err
+}
+
+// fillHourlyGaps turns the hourly averages into evenly spaced series,
+// linearly interpolating the hours without readings.
+func fillHourlyGaps(history []*HourlyAverage) ([]float64, []float64) {
+	first := history[0].Hour
+	steps := int(history[len(history)-1].Hour.Sub(first)/time.Hour) + 1
+
+	temperatures := make([]float64, steps)
+	humidities := make([]float64, steps)
+
+	prev := 0
+	for i, average := range history {
+		step := int(average.Hour.Sub(first) / time.Hour)
+		temperatures[step] = average.Temperature
+		humidities[step] = average.Humidity
+
+		if i > 0 {
+			for gap := prev + 1; gap < step; gap++ {
+				ratio := float64(gap-prev) / float64(step-prev)
+				temperatures[gap] = temperatures[prev] + ratio*(temperatures[step]-temperatures[prev])
+				humidities[gap] = humidities[prev] + ratio*(humidities[step]-humidities[prev])
+			}
+		}
+		prev = step
+	}
+
+	return temperatures, humidities
+}
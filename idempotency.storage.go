@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+func (s *PostgresStore) CreateIdempotencyKeyTable(ctx context.Context) error {
+	// The readings are not referenced as the partitioned weather table is
+	// keyed by (id, created_at)
+	_, err := s.db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS idempotency_keys (
+            device TEXT NOT NULL,
+            key TEXT NOT NULL,
+            request_hash TEXT NOT NULL,
+            weather_id UUID NULL,
+            created_at TIMESTAMP NOT NULL,
+            expires_at TIMESTAMP NOT NULL,
+            PRIMARY KEY (device, key)
+        );
+
+        CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+    `)
+	return err
+}
+
+// ClaimIdempotencyKey records key for the request about to run, unless the
+// device already used it. Expired keys, and keys left pending for longer
+// than idempotencyPendingTimeout, are claimed again, as are keys used for
+// another request when replace is set. It returns whether the key was
+// claimed, and otherwise the key already recorded.
+func (s *PostgresStore) ClaimIdempotencyKey(ctx context.Context, key *IdempotencyKey, replace bool) (bool, *IdempotencyKey, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var claimed bool
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO idempotency_keys (device, key, request_hash, weather_id, created_at, expires_at) 
+		VALUES ($1, $2, $3, NULL, $4, $5)
+		ON CONFLICT (device, key) DO UPDATE 
+		SET request_hash = EXCLUDED.request_hash, 
+			weather_id = NULL, 
+			created_at = EXCLUDED.created_at, 
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= EXCLUDED.created_at 
+			OR (idempotency_keys.weather_id IS NULL AND idempotency_keys.created_at < $6) 
+			OR ($7 AND idempotency_keys.request_hash <> EXCLUDED.request_hash)
+		RETURNING true
+	`,
+		key.Device,
+		key.Key,
+		key.RequestHash,
+		key.CreatedAt,
+		key.ExpiresAt,
+		key.CreatedAt.Add(-idempotencyPendingTimeout),
+		replace,
+	).Scan(&claimed)
+	if err == nil {
+		return true, nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, nil, err
+	}
+
+	existing := &IdempotencyKey{Device: key.Device, Key: key.Key}
+	err = s.db.QueryRowContext(ctx, `
+		SELECT request_hash, weather_id, created_at, expires_at 
+		FROM idempotency_keys 
+		WHERE device = $1 AND key = $2
+	`, key.Device, key.Key).Scan(
+		&existing.RequestHash,
+		&existing.WeatherID,
+		&existing.CreatedAt,
+		&existing.ExpiresAt,
+	)
+	if err != nil {
+		return false, nil, err
+	}
+
+	return false, existing, nil
+}
+
+// CompleteIdempotencyKey records the reading created for the request which
+// claimed key.
+func (s *PostgresStore) CompleteIdempotencyKey(ctx context.Context, key *IdempotencyKey, weatherID string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE idempotency_keys 
+		SET weather_id = $1 
+		WHERE device = $2 AND key = $3 AND created_at = $4
+	`
+
+	_, err := s.db.ExecContext(ctx, query, weatherID, key.Device, key.Key, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	key.WeatherID = &weatherID
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets key after the request which claimed it
+// failed, so that it may be retried right away.
+func (s *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, key *IdempotencyKey) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		DELETE FROM idempotency_keys 
+		WHERE device = $1 AND key = $2 AND created_at = $3 AND weather_id IS NULL
+	`
+
+	_, err := s.db.ExecContext(ctx, query, key.Device, key.Key, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes the keys expired at now and returns
+// how many were deleted.
+func (s *PostgresStore) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM idempotency_keys 
+		WHERE expires_at <= $1
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
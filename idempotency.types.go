@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// idempotencyKeyHeader carries the key under which a client retries a
+// request without it taking effect twice.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayedHeader marks the responses replayed for a known key.
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength bounds the keys accepted from clients.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyPendingTimeout is how long a key claimed by a request which
+// never completed blocks its retries.
+const idempotencyPendingTimeout = time.Minute
+
+// IdempotencyKey records the reading created for a request sent by a
+// device under a key, so that its retries return that reading. WeatherID
+// is nil while the request is in progress.
+type IdempotencyKey struct {
+	Device      string
+	Key         string
+	RequestHash string
+	WeatherID   *string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// NewIdempotencyKey creates the key of a request sent by device, expiring
+// after ttl.
+func NewIdempotencyKey(device, key string, req any, ttl time.Duration) (*IdempotencyKey, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(body)
+
+	// Truncated to the precision of the database, which matches keys on it
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	return &IdempotencyKey{
+		Device:      device,
+		Key:         key,
+		RequestHash: hex.EncodeToString(hash[:]),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}, nil
+}
@@ -1,27 +1,167 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/joho/godotenv"
+	"io/fs"
 	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
+	// The .env file is optional now that settings may come from a config file
 	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+
+	// Configuration
+	cfg, args, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Structured logging, also used by the standard logger
+	logger, err := NewLogger(cfg.Log)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	// Printing the configuration doesn't need the database
+	if len(args) == 2 && args[0] == "config" && args[1] == "print" {
+		if err := printConfig(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Stop on SIGINT and SIGTERM, letting requests and jobs in progress finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Tracing, flushed once everything else is stopped
+	shutdownTracing, err := SetupTracing(ctx, cfg.Tracing)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("flushing traces", "error", err)
+		}
+	}()
 
 	// DB setup
-	store, err := NewPostgresStore()
+	store, err := NewPostgresStore(ctx, cfg.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// DB init
-	if err := store.Init(); err != nil {
+	if err := store.Init(ctx); err != nil {
 		log.Fatal(err)
 	}
 
-	server := NewAPIServer(":3000", store)
-	server.Run()
+	// Command line commands run against the store and exit
+	if len(args) > 0 {
+		err := runCommand(ctx, store, args)
+		if closeErr := store.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Background workers are waited for before the database is closed
+	var workers sync.WaitGroup
+
+	// Stale station monitor
+	notifier := MultiNotifier{LogNotifier{}}
+	if cfg.Stations.WebhookURL != "" {
+		notifier = append(notifier, NewWebhookNotifier(cfg.Stations.WebhookURL))
+	}
+
+	monitor := NewStationMonitor(store, notifier, cfg.Stations.StaleAfter.Duration, cfg.Stations.CheckInterval.Duration)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		monitor.Run(ctx)
+	}()
+
+	// Forecasting engine
+	if cfg.Forecast.Enabled {
+		models, err := forecastModelsByName(cfg.Forecast.Models)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		forecaster := NewForecaster(store, models, cfg.Forecast.Interval.Duration, cfg.Forecast.HorizonHours, cfg.Forecast.History.Duration)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			forecaster.Run(ctx)
+		}()
+	}
+
+	// Retention and downsampling
+	defaultRetention, err := NewRetentionPolicy("", cfg.Retention.RawDays, cfg.Retention.HourlyDays)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	retention := NewRetentionJob(store, *defaultRetention, cfg.Retention.Interval.Duration, cfg.Retention.DeletedGracePeriod.Duration)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		retention.Run(ctx)
+	}()
+
+	// Rate limits and minimum interval between the readings of a device
+	limiter := NewRateLimiter(cfg.RateLimit)
+	readingInterval := cfg.RateLimit.ReadingInterval.Duration
+	if !cfg.RateLimit.Enabled {
+		readingInterval = 0
+	}
+	throttle := NewReadingThrottle(store, readingInterval, cfg.RateLimit.ReadingMode)
+
+	// Signatures of the device requests and roles of the API tokens
+	verifier := NewSignatureVerifier(store, cfg.Signing)
+	authorizer := NewAuthorizer(store, cfg.Auth)
+	if !cfg.Auth.Enabled {
+		slog.Warn("access control is disabled, every route is open to anyone; set AUTH_ENABLED to require API tokens")
+	}
+
+	// HTTP server, only failing to serve is fatal as a timed out shutdown
+	// must still close the jobs and the database
+	server := NewAPIServer(cfg.Server, store, monitor, retention, limiter, throttle, verifier, authorizer)
+	if err := server.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	// The server is drained, wait for the jobs in progress, bounded by the
+	// same shutdown timeout, before closing the database
+	shutdownTimeout := cfg.Server.ShutdownTimeout.Duration
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		slog.Warn("background jobs still running", "timeout", shutdownTimeout)
+	}
+
+	if err := store.Close(); err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("shutdown complete")
 }
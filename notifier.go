@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Notifier delivers station events to whoever needs to know about them.
+type Notifier interface {
+	Notify(event StationEvent) error
+}
+
+// LogNotifier writes station events to the standard logger.
+type LogNotifier struct{}
+
+// Notify logs the given event.
+func (LogNotifier) Notify(event StationEvent) error {
+	log.Printf("%s: city %s [%s], last seen at %v", event.Type, event.CityName, event.CityID, event.LastSeenAt)
+	return nil
+}
+
+// WebhookNotifier posts station events as JSON to a configured URL.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a new instance of WebhookNotifier.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify sends the event to the webhook URL.
+func (n *WebhookNotifier) Notify(event StationEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("webhook %s responded with status %d", n.url, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// MultiNotifier fans an event out to several notifiers.
+type MultiNotifier []Notifier
+
+// Notify sends the event to every notifier and returns the first error, if any.
+func (m MultiNotifier) Notify(event StationEvent) error {
+	var firstErr error
+	for _, n := range m {
+		if err := n.Notify(event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
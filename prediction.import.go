@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats accepted by ImportPredictions.
+const (
+	PredictionImportOpenMeteo = "open-meteo"
+	PredictionImportCSV       = "csv"
+)
+
+// PredictionImportOptions configures how an external forecast file is
+// mapped to predictions. The city given here applies to every row; when it
+// is empty each row is matched by its own city_id, city name or coordinates.
+type PredictionImportOptions struct {
+	Format   string
+	CityID   string
+	CityName string
+	Source   string
+	Model    string
+	IssuedAt *time.Time
+	Partial  bool
+}
+
+// PredictionImportResult reports the outcome of an import. Rejected
+// indexes refer to the rows of the file, in order.
+type PredictionImportResult struct {
+	Error    string                 `json:"error,omitempty"`
+	Imported int                    `json:"imported"`
+	Rejected []PredictionBatchError `json:"rejected"`
+}
+
+// ImportPredictions parses an Open-Meteo hourly response or a CSV forecast
+// file and stores its rows as predictions in a single transaction. Unless
+// opts.Partial is set, any rejected row aborts the whole import.
+func ImportPredictions(ctx context.Context, store Storage, r io.Reader, opts PredictionImportOptions) (*PredictionImportResult, error) {
+	resolver, err := newCityResolver(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []forecastRow
+	switch opts.Format {
+	case PredictionImportOpenMeteo:
+		rows, err = parseOpenMeteo(r)
+		if opts.Source == "" {
+			opts.Source = "open-meteo"
+		}
+	case PredictionImportCSV:
+		rows, err = parseForecastCSV(r)
+		if opts.Source == "" {
+			opts.Source = "csv"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported import format: %s", opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var model *string
+	if opts.Model != "" {
+		model = &opts.Model
+	}
+
+	// Rows that cannot be turned into a request keep their index so the
+	// report lines up with the file
+	reqs := make([]CreatePredictionRequest, 0, len(rows))
+	indexes := make([]int, 0, len(rows))
+	result := &PredictionImportResult{Rejected: []PredictionBatchError{}}
+	for i, row := range rows {
+		reject := func(err error) {
+			result.Rejected = append(result.Rejected, PredictionBatchError{Index: i, CityID: row.CityID, Error: err.Error()})
+		}
+
+		if row.Err != nil {
+			reject(row.Err)
+			continue
+		}
+
+		cityID, err := resolver.resolve(
+			firstNonEmpty(opts.CityID, row.CityID),
+			firstNonEmpty(opts.CityName, row.CityName),
+			row.Latitude,
+			row.Longitude,
+		)
+		if err != nil {
+			reject(err)
+			continue
+		}
+
+		req := CreatePredictionRequest{
+			CityID:      cityID,
+			Temperature: row.Temperature,
+			Humidity:    row.Humidity,
+			ForecastFor: row.ForecastFor,
+			Source:      opts.Source,
+			Model:       model,
+			IssuedAt:    opts.IssuedAt,
+		}
+		if row.Source != "" {
+			req.Source = row.Source
+		}
+		if row.Model != "" {
+			rowModel := row.Model
+			req.Model = &rowModel
+		}
+		if row.IssuedAt != nil {
+			req.IssuedAt = row.IssuedAt
+		}
+
+		reqs = append(reqs, req)
+		indexes = append(indexes, i)
+	}
+
+	predictions, rejected, err := validatePredictionRequests(ctx, store, reqs)
+	if err != nil {
+		return nil, err
+	}
+	for _, rejection := range rejected {
+		rejection.Index = indexes[rejection.Index]
+		result.Rejected = append(result.Rejected, rejection)
+	}
+
+	if len(result.Rejected) > 0 && !opts.Partial {
+		result.Error = fmt.Sprintf("%d of %d rows are invalid, nothing was imported", len(result.Rejected), len(rows))
+		return result, errors.New(result.Error)
+	}
+
+	created, err := store.CreatePredictions(ctx, predictions)
+	if err != nil {
+		return nil, err
+	}
+	result.Imported = len(created)
+
+	return result, nil
+}
+
+// forecastRow is a single hourly value read from an external file.
+type forecastRow struct {
+	CityID      string
+	CityName    string
+	Latitude    *float64
+	Longitude   *float64
+	ForecastFor time.Time
+	Temperature float64
+	Humidity    float64
+	Source      string
+	Model       string
+	IssuedAt    *time.Time
+	Err         error
+}
+
+// openMeteoResponse is the subset of an Open-Meteo forecast response used
+// by the importer.
+type openMeteoResponse struct {
+	Latitude         float64 `json:"latitude"`
+	Longitude        float64 `json:"longitude"`
+	UTCOffsetSeconds int     `json:"utc_offset_seconds"`
+	Hourly           struct {
+		Time               []json.RawMessage `json:"time"`
+		Temperature2m      []*float64        `json:"temperature_2m"`
+		RelativeHumidity2m []*float64        `json:"relative_humidity_2m"`
+	} `json:"hourly"`
+}
+
+// parseOpenMeteo reads an Open-Meteo hourly response, or the array returned
+// when several locations are requested at once. Times may be ISO 8601 in
+// the response time zone or unix timestamps.
+func parseOpenMeteo(r io.Reader) ([]forecastRow, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []openMeteoResponse
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &responses)
+	} else {
+		var response openMeteoResponse
+		err = json.Unmarshal(trimmed, &response)
+		responses = append(responses, response)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid open-meteo response: %v", err)
+	}
+
+	var rows []forecastRow
+	for _, response := range responses {
+		hourly := response.Hourly
+		if hourly.Temperature2m == nil || hourly.RelativeHumidity2m == nil {
+			return nil, fmt.Errorf("open-meteo response must contain hourly temperature_2m and relative_humidity_2m")
+		}
+		if len(hourly.Temperature2m) != len(hourly.Time) || len(hourly.RelativeHumidity2m) != len(hourly.Time) {
+			return nil, fmt.Errorf("open-meteo hourly arrays have different lengths")
+		}
+
+		location := time.FixedZone("", response.UTCOffsetSeconds)
+		latitude, longitude := response.Latitude, response.Longitude
+
+		for i, raw := range hourly.Time {
+			row := forecastRow{Latitude: &latitude, Longitude: &longitude}
+
+			forecastFor, err := parseOpenMeteoTime(raw, location)
+			switch {
+			case err != nil:
+				row.Err = err
+			case hourly.Temperature2m[i] == nil || hourly.RelativeHumidity2m[i] == nil:
+				row.Err = fmt.Errorf("missing value at %s", forecastFor.Format(time.RFC3339))
+			default:
+				row.ForecastFor = forecastFor
+				row.Temperature = *hourly.Temperature2m[i]
+				row.Humidity = *hourly.RelativeHumidity2m[i]
+			}
+
+			rows = append(rows, row)
+		}
+	}
+
+	return rows, nil
+}
+
+func parseOpenMeteoTime(raw json.RawMessage, location *time.Location) (time.Time, error) {
+	var unix int64
+	if err := json.Unmarshal(raw, &unix); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %s", raw)
+	}
+
+	t, err := time.ParseInLocation("2006-01-02T15:04", value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %s", value)
+	}
+	return t.UTC(), nil
+}
+
+// forecastCSVColumns maps the accepted CSV headers to the field they fill.
+var forecastCSVColumns = map[string]string{
+	"forecast_for":         "forecast_for",
+	"time":                 "forecast_for",
+	"timestamp":            "forecast_for",
+	"temperature":          "temperature",
+	"temperature_2m":       "temperature",
+	"humidity":             "humidity",
+	"relative_humidity_2m": "humidity",
+	"city_id":              "city_id",
+	"city":                 "city",
+	"latitude":             "latitude",
+	"longitude":            "longitude",
+	"source":               "source",
+	"model":                "model",
+	"issued_at":            "issued_at",
+}
+
+// parseForecastCSV reads a CSV file with a header row. forecast_for,
+// temperature and humidity are required; city_id, city, latitude,
+// longitude, source, model and issued_at are optional. Times are RFC 3339.
+func parseForecastCSV(r io.Reader) ([]forecastRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		if field, ok := forecastCSVColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = i
+		}
+	}
+	for _, required := range []string{"forecast_for", "temperature", "humidity"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("csv is missing the %s column", required)
+		}
+	}
+
+	var rows []forecastRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, parseForecastCSVRecord(record, columns))
+	}
+
+	return rows, nil
+}
+
+func parseForecastCSVRecord(record []string, columns map[string]int) forecastRow {
+	var row forecastRow
+	get := func(field string) string {
+		i, ok := columns[field]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var err error
+	if row.ForecastFor, err = time.Parse(time.RFC3339, get("forecast_for")); err != nil {
+		row.Err = fmt.Errorf("invalid forecast_for %q", get("forecast_for"))
+		return row
+	}
+	if row.Temperature, err = strconv.ParseFloat(get("temperature"), 64); err != nil {
+		row.Err = fmt.Errorf("invalid temperature %q", get("temperature"))
+		return row
+	}
+	if row.Humidity, err = strconv.ParseFloat(get("humidity"), 64); err != nil {
+		row.Err = fmt.Errorf("invalid humidity %q", get("humidity"))
+		return row
+	}
+
+	row.CityID = get("city_id")
+	row.CityName = get("city")
+	row.Source = get("source")
+	row.Model = get("model")
+
+	if get("latitude") != "" || get("longitude") != "" {
+		latitude, errLat := strconv.ParseFloat(get("latitude"), 64)
+		longitude, errLon := strconv.ParseFloat(get("longitude"), 64)
+		if errLat != nil || errLon != nil {
+			row.Err = fmt.Errorf("invalid coordinates %q, %q", get("latitude"), get("longitude"))
+			return row
+		}
+		row.Latitude, row.Longitude = &latitude, &longitude
+	}
+
+	if value := get("issued_at"); value != "" {
+		issuedAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			row.Err = fmt.Errorf("invalid issued_at %q", value)
+			return row
+		}
+		row.IssuedAt = &issuedAt
+	}
+
+	row.ForecastFor = row.ForecastFor.UTC()
+	return row
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openFixture(t *testing.T, name string) *os.File {
+	t.Helper()
+
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseOpenMeteo(t *testing.T) {
+	rows, err := parseOpenMeteo(openFixture(t, "open-meteo-hourly.json"))
+	if err != nil {
+		t.Fatalf("parseOpenMeteo() error = %v", err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("got %d rows, want 4", len(rows))
+	}
+
+	// Times are in the response time zone, UTC-5
+	first := rows[0]
+	if first.Err != nil {
+		t.Fatalf("rows[0].Err = %v", first.Err)
+	}
+	if want := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC); !first.ForecastFor.Equal(want) {
+		t.Errorf("rows[0].ForecastFor = %s, want %s", first.ForecastFor, want)
+	}
+	if first.Temperature != 18.4 || first.Humidity != 82 {
+		t.Errorf("rows[0] = %.1f °C, %.0f %%, want 18.4 °C, 82 %%", first.Temperature, first.Humidity)
+	}
+	if first.Latitude == nil || *first.Latitude != 6.25 || first.Longitude == nil || *first.Longitude != -75.5625 {
+		t.Errorf("rows[0] coordinates = %v, %v", first.Latitude, first.Longitude)
+	}
+
+	if rows[2].Err == nil {
+		t.Errorf("rows[2] has no temperature but no error")
+	}
+	if rows[3].Err != nil || rows[3].Temperature != 17.1 {
+		t.Errorf("rows[3] = %+v", rows[3])
+	}
+}
+
+func TestParseOpenMeteoLocations(t *testing.T) {
+	// Several locations at once, with unix times
+	body := `[
+		{"latitude": 6.25, "longitude": -75.5625, "hourly": {"time": [1709269200], "temperature_2m": [18.4], "relative_humidity_2m": [82]}},
+		{"latitude": 4.625, "longitude": -74.0625, "hourly": {"time": [1709269200], "temperature_2m": [12.3], "relative_humidity_2m": [75]}}
+	]`
+	rows, err := parseOpenMeteo(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("parseOpenMeteo() error = %v", err)
+	}
+	if len(rows) != 2 || *rows[1].Latitude != 4.625 || rows[1].Temperature != 12.3 {
+		t.Fatalf("rows = %+v", rows)
+	}
+	if want := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC); !rows[0].ForecastFor.Equal(want) {
+		t.Errorf("rows[0].ForecastFor = %s, want %s", rows[0].ForecastFor, want)
+	}
+
+	for name, body := range map[string]string{
+		"invalid json":     `{"hourly":`,
+		"missing humidity": `{"hourly": {"time": ["2024-03-01T00:00"], "temperature_2m": [18.4]}}`,
+		"different length": `{"hourly": {"time": ["2024-03-01T00:00"], "temperature_2m": [18.4, 17.9], "relative_humidity_2m": [82]}}`,
+	} {
+		if _, err := parseOpenMeteo(strings.NewReader(body)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestParseForecastCSV(t *testing.T) {
+	rows, err := parseForecastCSV(openFixture(t, "forecast.csv"))
+	if err != nil {
+		t.Fatalf("parseForecastCSV() error = %v", err)
+	}
+	if len(rows) != 6 {
+		t.Fatalf("got %d rows, want 6", len(rows))
+	}
+
+	// Headers are matched by their aliases, whatever their case
+	first := rows[0]
+	if first.Err != nil {
+		t.Fatalf("rows[0].Err = %v", first.Err)
+	}
+	if first.Temperature != 18.4 || first.Humidity != 82 || first.CityName != "Medellín" || first.Model != "gfs" {
+		t.Errorf("rows[0] = %+v", first)
+	}
+	if first.IssuedAt == nil || !first.IssuedAt.Equal(time.Date(2024, 2, 29, 18, 0, 0, 0, time.UTC)) {
+		t.Errorf("rows[0].IssuedAt = %v", first.IssuedAt)
+	}
+
+	if rows[1].Err != nil {
+		t.Fatalf("rows[1].Err = %v", rows[1].Err)
+	}
+	if want := time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC); rows[1].ForecastFor != want {
+		t.Errorf("rows[1].ForecastFor = %s, want %s", rows[1].ForecastFor, want)
+	}
+
+	for i, want := range map[int]string{
+		2: "invalid forecast_for",
+		3: "invalid temperature",
+		4: "invalid humidity",
+		5: "invalid issued_at",
+	} {
+		if rows[i].Err == nil || !strings.Contains(rows[i].Err.Error(), want) {
+			t.Errorf("rows[%d].Err = %v, want %s", i, rows[i].Err, want)
+		}
+	}
+
+	if _, err := parseForecastCSV(strings.NewReader("time,temperature\n2024-03-01T05:00:00Z,18.4\n")); err == nil {
+		t.Errorf("no error for a csv without humidity")
+	}
+}
+
+func TestCityResolverCoordinates(t *testing.T) {
+	latitude, longitude := 6.2442, -75.5812
+	bogotaLatitude, bogotaLongitude := 4.711, -74.0721
+	store := &fakeStore{cities: []*City{
+		{ID: testCityID, Name: "Medellín", Latitude: &latitude, Longitude: &longitude},
+		{ID: "0b5d8a3e-2f41-4c6e-8d7a-9e1f2a3b4c5d", Name: "Bogotá", Latitude: &bogotaLatitude, Longitude: &bogotaLongitude},
+		{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d", Name: "Nowhere"},
+	}}
+
+	resolver, err := newCityResolver(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The grid point of the Open-Meteo fixture, about 2 km away
+	lat, lon := 6.25, -75.5625
+	cityID, err := resolver.resolve("", "", &lat, &lon)
+	if err != nil || cityID != testCityID {
+		t.Errorf("resolve(%v, %v) = %q, %v, want %q", lat, lon, cityID, err, testCityID)
+	}
+
+	// Cartagena is hundreds of kilometres from both
+	lat, lon = 10.391, -75.4794
+	if cityID, err := resolver.resolve("", "", &lat, &lon); err == nil {
+		t.Errorf("resolve(%v, %v) = %q, want no match", lat, lon, cityID)
+	}
+
+	if distance := haversineKm(latitude, longitude, bogotaLatitude, bogotaLongitude); distance < 230 || distance > 250 {
+		t.Errorf("haversineKm(Medellín, Bogotá) = %.1f km, want about 240 km", distance)
+	}
+	if distance := haversineKm(latitude, longitude, latitude, longitude); distance != 0 {
+		t.Errorf("haversineKm of the same point = %f", distance)
+	}
+}
+
+func TestCityResolverNames(t *testing.T) {
+	store := &fakeStore{cities: []*City{
+		{ID: testCityID, Name: "Medellín"},
+		{ID: "0b5d8a3e-2f41-4c6e-8d7a-9e1f2a3b4c5d", Name: "San José"},
+		{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d", Name: "san josé"},
+	}}
+
+	resolver, err := newCityResolver(context.Background(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cityID, err := resolver.resolve("", "MEDELLÍN", nil, nil); err != nil || cityID != testCityID {
+		t.Errorf("resolve(MEDELLÍN) = %q, %v, want %q", cityID, err, testCityID)
+	}
+
+	// Two cities share the name, neither is picked
+	cityID, err := resolver.resolve("", "San José", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("resolve(San José) = %q, %v, want an ambiguous name error", cityID, err)
+	}
+}
@@ -1,20 +1,163 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
 	"net/http"
+	"time"
 )
 
 func (server *APIServer) handleCreatePrediction(w http.ResponseWriter, r *http.Request) error {
+	partial := r.URL.Query().Get("partial") == "true"
+
 	var reqs []CreatePredictionRequest
 	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
 		return err
 	}
 
-	var createdPredictions []*Prediction
+	predictions, rejected, err := validatePredictionRequests(r.Context(), server.store, reqs)
+	if err != nil {
+		return err
+	}
+
+	// Without partial mode a single invalid item rejects the whole batch
+	if len(rejected) > 0 && !partial {
+		return WriteJSON(w, http.StatusBadRequest, PredictionBatchResponse{
+			Error:    fmt.Sprintf("%d of %d predictions are invalid, nothing was stored", len(rejected), len(reqs)),
+			Created:  []*Prediction{},
+			Rejected: rejected,
+		})
+	}
+
+	createdPredictions, err := server.store.CreatePredictions(r.Context(), predictions)
+	if err != nil {
+		return err
+	}
+
+	if !partial {
+		return WriteJSON(w, http.StatusOK, createdPredictions)
+	}
+
+	if rejected == nil {
+		rejected = []PredictionBatchError{}
+	}
+
+	return WriteJSON(w, http.StatusOK, PredictionBatchResponse{
+		Created:  createdPredictions,
+		Rejected: rejected,
+	})
+}
+
+// validatePredictionRequests builds the predictions of a batch, checking
+// the existence of each distinct city once. City IDs are compared in their
+// canonical lowercase form, as returned by the store. Items that cannot be
+// stored are reported by their index in reqs instead of failing the whole
+// batch.
+func validatePredictionRequests(ctx context.Context, store Storage, reqs []CreatePredictionRequest) ([]*Prediction, []PredictionBatchError, error) {
+	var cityIDs []string
+	seen := make(map[string]bool)
+	for _, req := range reqs {
+		if id, err := uuid.Parse(req.CityID); err == nil && !seen[id.String()] {
+			seen[id.String()] = true
+			cityIDs = append(cityIDs, id.String())
+		}
+	}
+
+	existing, err := store.GetExistingCityIDs(ctx, cityIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var predictions []*Prediction
+	var rejected []PredictionBatchError
+	for i, req := range reqs {
+		reject := func(format string, a ...any) {
+			rejected = append(rejected, PredictionBatchError{
+				Index:  i,
+				CityID: req.CityID,
+				Error:  fmt.Sprintf(format, a...),
+			})
+		}
+
+		id, err := uuid.Parse(req.CityID)
+		switch {
+		case err != nil:
+			reject("invalid city id %s", req.CityID)
+			continue
+		case !existing[id.String()]:
+			reject("city [%s] not found", req.CityID)
+			continue
+		case req.ForecastFor.IsZero():
+			reject("forecast_for is required")
+			continue
+		}
+
+		prediction, err := NewPrediction(
+			id.String(),
+			req.Temperature,
+			req.Humidity,
+			req.ForecastFor,
+			req.Source,
+			req.Model,
+			req.IssuedAt,
+		)
+		if err != nil {
+			reject("%v", err)
+			continue
+		}
+
+		predictions = append(predictions, prediction)
+	}
+
+	return predictions, rejected, nil
+}
+
+func (server *APIServer) handleGetPredictions(w http.ResponseWriter, r *http.Request) error {
+	cityID := r.URL.Query().Get("city_id")
+	if cityID == "" {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "city_id is required"})
+	}
+
+	query := PredictionQuery{
+		Source: r.URL.Query().Get("source"),
+		Model:  r.URL.Query().Get("model"),
+	}
+	if r.URL.Query().Get("issued_at") != "" {
+		issuedAt, err := getTimeParam(r, "issued_at", time.Time{})
+		if err != nil {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		query.IssuedAt = &issuedAt
+	}
+
+	format, err := getExportFormat(r)
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if format != ExportJSON {
+		return server.handleExportPredictions(w, r, cityID, query, format)
+	}
+
+	predictions, err := server.store.GetPredictionsByCityID(r.Context(), cityID, query)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, predictions)
+}
+
+func (server *APIServer) handleUpsertPredictions(w http.ResponseWriter, r *http.Request) error {
+	var reqs []CreatePredictionRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		return err
+	}
+
+	var upsertedPredictions []*Prediction
 	for _, req := range reqs {
 		// Verify the city exists
-		_, err := server.store.GetCityByID(req.CityID)
+		_, err := server.store.GetCityByID(r.Context(), req.CityID)
 		if err != nil {
 			return err
 		}
@@ -24,38 +167,154 @@ func (server *APIServer) handleCreatePrediction(w http.ResponseWriter, r *http.R
 			req.Temperature,
 			req.Humidity,
 			req.ForecastFor,
+			req.Source,
+			req.Model,
+			req.IssuedAt,
 		)
 		if err != nil {
 			return err
 		}
 
-		err = server.store.CreatePrediction(prediction)
+		_, err = server.store.UpsertPrediction(r.Context(), prediction)
 		if err != nil {
 			return err
 		}
 
 		// Recovering prediction from DB
-		createdPrediction, err := server.store.GetPredictionByID(prediction.ID)
+		upsertedPrediction, err := server.store.GetPredictionByID(r.Context(), prediction.ID)
 		if err != nil {
 			return err
 		}
 
-		createdPredictions = append(createdPredictions, createdPrediction)
+		upsertedPredictions = append(upsertedPredictions, upsertedPrediction)
 	}
 
-	return WriteJSON(w, http.StatusOK, createdPredictions)
+	return WriteJSON(w, http.StatusOK, upsertedPredictions)
 }
 
-func (server *APIServer) handleGetPredictions(w http.ResponseWriter, r *http.Request) error {
-	cityID := r.URL.Query().Get("city_id")
-	if cityID == "" {
-		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "city_id is required"})
+func (server *APIServer) handleDeletePredictions(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Query().Get("before") == "" {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "before is required"})
+	}
+
+	before, err := getTimeParam(r, "before", time.Time{})
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
 
-	predictions, err := server.store.GetPredictionsByCityID(cityID)
+	deleted, err := server.store.DeletePredictionsBefore(r.Context(), before, r.URL.Query().Get("city_id"))
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, predictions)
+	return WriteJSON(w, http.StatusOK, map[string]int64{"deleted": deleted})
+}
+
+func (server *APIServer) handleGetPredictionByID(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	prediction, err := server.store.GetPredictionByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, prediction)
+}
+
+func (server *APIServer) handleUpdatePrediction(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = server.store.GetPredictionByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	var prediction Prediction
+	if err := json.NewDecoder(r.Body).Decode(&prediction); err != nil {
+		return err
+	}
+
+	// The prediction is replaced, with the defaults of a new one
+	prediction.ID = id
+	if prediction.Source == "" {
+		prediction.Source = PredictionSourceExternal
+	}
+	if prediction.IssuedAt.IsZero() {
+		prediction.IssuedAt = time.Now().UTC()
+	}
+
+	// Verify the city exists
+	_, err = server.store.GetCityByID(r.Context(), prediction.CityID)
+	if err != nil {
+		return err
+	}
+
+	if err := server.store.UpdatePrediction(r.Context(), &prediction); err != nil {
+		return err
+	}
+
+	// Recovering data from DB to get the most up-to-date data
+	updatedPrediction, err := server.store.GetPredictionByID(r.Context(), prediction.ID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, updatedPrediction)
+}
+
+func (server *APIServer) handleDeletePrediction(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	err = server.store.DeletePrediction(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": id})
+}
+
+func (server *APIServer) handleImportPredictions(w http.ResponseWriter, r *http.Request) error {
+	// Uploads may take longer than the server read timeout allows
+	if err := clearDeadlines(w); err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	opts := PredictionImportOptions{
+		Format:   query.Get("format"),
+		CityID:   query.Get("city_id"),
+		CityName: query.Get("city"),
+		Source:   query.Get("source"),
+		Model:    query.Get("model"),
+		Partial:  query.Get("partial") == "true",
+	}
+	if opts.Format == "" {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "format is required"})
+	}
+	if query.Get("issued_at") != "" {
+		issuedAt, err := getTimeParam(r, "issued_at", time.Time{})
+		if err != nil {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		opts.IssuedAt = &issuedAt
+	}
+
+	result, err := ImportPredictions(r.Context(), server.store, r.Body, opts)
+	if err != nil {
+		if result != nil {
+			return WriteJSON(w, http.StatusBadRequest, result)
+		}
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePredictionRequestsCityIDCase(t *testing.T) {
+	store := &fakeStore{cities: []*City{{ID: testCityID, Name: "Medellín"}}}
+	forecastFor := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC)
+	reqs := []CreatePredictionRequest{
+		{CityID: testCityID, Temperature: 18.4, Humidity: 82, ForecastFor: forecastFor},
+		{CityID: strings.ToUpper(testCityID), Temperature: 17.9, Humidity: 85, ForecastFor: forecastFor},
+		{CityID: "not-a-uuid", Temperature: 17.5, Humidity: 86, ForecastFor: forecastFor},
+		{CityID: "0B5D8A3E-2F41-4C6E-8D7A-9E1F2A3B4C5D", Temperature: 17.1, Humidity: 88, ForecastFor: forecastFor},
+	}
+
+	predictions, rejected, err := validatePredictionRequests(context.Background(), store, reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(predictions) != 2 || predictions[1].CityID != testCityID {
+		t.Errorf("predictions = %+v, want both Medellín ones with its canonical ID", predictions)
+	}
+	if len(rejected) != 2 || rejected[0].Index != 2 || rejected[1].Index != 3 {
+		t.Errorf("rejected = %+v, want indexes 2 and 3", rejected)
+	}
+}
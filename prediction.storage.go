@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
+	"time"
 )
 
-func (s *PostgresStore) CreatePredictionTable() error {
+// predictionColumns lists the predictions columns in the order expected by scanIntoPrediction.
+const predictionColumns = "id, city_id, temperature, humidity, forecast_for, created_at, updated_at, source, model, issued_at, deleted_at"
+
+func (s *PostgresStore) CreatePredictionTable(ctx context.Context) error {
 	// Create the table if it doesn't exist
-	_, err := s.db.Exec(`	
+	_, err := s.db.ExecContext(ctx, `	
         CREATE TABLE IF NOT EXISTS predictions (
             id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
             city_id UUID NOT NULL,
@@ -24,9 +30,35 @@ func (s *PostgresStore) CreatePredictionTable() error {
 		return err
 	}
 
+	// Metadata about who produced the prediction and when it was issued.
+	// Predictions stored before issued_at existed are considered issued
+	// when they were created.
+	_, err = s.db.ExecContext(ctx, `
+        ALTER TABLE predictions ADD COLUMN IF NOT EXISTS model TEXT NULL;
+        ALTER TABLE predictions ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'external';
+        ALTER TABLE predictions ADD COLUMN IF NOT EXISTS issued_at TIMESTAMP NULL;
+        UPDATE predictions SET issued_at = created_at WHERE issued_at IS NULL;
+        ALTER TABLE predictions ALTER COLUMN issued_at SET DEFAULT CURRENT_TIMESTAMP;
+        ALTER TABLE predictions ALTER COLUMN issued_at SET NOT NULL;
+        CREATE INDEX IF NOT EXISTS predictions_city_id_forecast_for_issued_at_idx 
+        ON predictions (city_id, forecast_for, issued_at);
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Deleted predictions are kept until purged once past the grace period
+	_, err = s.db.ExecContext(ctx, `
+        ALTER TABLE predictions ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP NULL;
+        CREATE INDEX IF NOT EXISTS predictions_deleted_at_idx ON predictions (deleted_at) WHERE deleted_at IS NOT NULL;
+    `)
+	if err != nil {
+		return err
+	}
+
 	// Check if the updated_at trigger already exists
 	var triggerExists bool
-	err = s.db.QueryRow(`
+	err = s.db.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 FROM pg_trigger 
             WHERE tgname = 'predictions_updated_at_trigger' 
@@ -38,7 +70,7 @@ func (s *PostgresStore) CreatePredictionTable() error {
 
 	// Create the updated_at trigger only if it doesn't exist
 	if !triggerExists {
-		_, err = s.db.Exec(`
+		_, err = s.db.ExecContext(ctx, `
             CREATE OR REPLACE FUNCTION update_prediction_timestamp()
             RETURNS TRIGGER AS $$
             BEGIN
@@ -60,7 +92,7 @@ func (s *PostgresStore) CreatePredictionTable() error {
 	}
 
 	// Check if the created_at trigger already exists
-	err = s.db.QueryRow(`
+	err = s.db.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 FROM pg_trigger 
             WHERE tgname = 'predictions_created_at_trigger' 
@@ -72,7 +104,7 @@ func (s *PostgresStore) CreatePredictionTable() error {
 
 	// Create the created_at trigger only if it doesn't exist
 	if !triggerExists {
-		_, err = s.db.Exec(`
+		_, err = s.db.ExecContext(ctx, `
             CREATE OR REPLACE FUNCTION set_prediction_created_at()
             RETURNS TRIGGER AS $$
             BEGIN
@@ -94,20 +126,27 @@ func (s *PostgresStore) CreatePredictionTable() error {
 	return nil
 }
 
-func (s *PostgresStore) CreatePrediction(prediction *Prediction) error {
+func (s *PostgresStore) CreatePrediction(ctx context.Context, prediction *Prediction) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-		INSERT INTO predictions (city_id, temperature, humidity, forecast_for) 
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO predictions (city_id, temperature, humidity, forecast_for, source, model, issued_at) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id
 	`
 
 	var id string
-	err := s.db.QueryRow(
+	err := s.db.QueryRowContext(
+		ctx,
 		query,
 		prediction.CityID,
 		prediction.Temperature,
 		prediction.Humidity,
 		prediction.ForecastFor,
+		prediction.Source,
+		prediction.Model,
+		prediction.IssuedAt,
 	).Scan(&id)
 	if err != nil {
 		return err
@@ -117,16 +156,88 @@ func (s *PostgresStore) CreatePrediction(prediction *Prediction) error {
 	return nil
 }
 
-func (s *PostgresStore) GetPredictionByID(id string) (*Prediction, error) {
-	rows, err := s.db.Query("SELECT * FROM predictions WHERE id = $1", id)
+// predictionBatchSize caps the rows per INSERT so the statement stays
+// below the Postgres limit of 65535 bind parameters.
+const predictionBatchSize = 1000
+
+// CreatePredictions inserts all the predictions in a single transaction
+// using multi-row inserts and returns the stored rows in the same order.
+// Either every prediction is stored or none is.
+func (s *PostgresStore) CreatePredictions(ctx context.Context, predictions []*Prediction) ([]*Prediction, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created := make([]*Prediction, 0, len(predictions))
+	for start := 0; start < len(predictions); start += predictionBatchSize {
+		end := min(start+predictionBatchSize, len(predictions))
+
+		values := make([]string, 0, end-start)
+		args := make([]any, 0, (end-start)*7)
+		for _, prediction := range predictions[start:end] {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7))
+			args = append(args,
+				prediction.CityID,
+				prediction.Temperature,
+				prediction.Humidity,
+				prediction.ForecastFor,
+				prediction.Source,
+				prediction.Model,
+				prediction.IssuedAt,
+			)
+		}
+
+		query := `
+			INSERT INTO predictions (city_id, temperature, humidity, forecast_for, source, model, issued_at) 
+			VALUES ` + strings.Join(values, ", ") + `
+			RETURNING ` + predictionColumns
+
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			prediction, err := scanIntoPrediction(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			created = append(created, prediction)
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+func (s *PostgresStore) GetPredictionByID(ctx context.Context, id string) (*Prediction, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+predictionColumns+" FROM predictions WHERE id = $1 AND "+notDeleted(ctx), id)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(rows *sql.Rows) {
+	defer func(rows *tracedRows) {
 		err := rows.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}(rows)
 
@@ -137,31 +248,73 @@ func (s *PostgresStore) GetPredictionByID(id string) (*Prediction, error) {
 	return nil, fmt.Errorf("prediction [%s] not found", id)
 }
 
-func (s *PostgresStore) GetPredictionsByCityID(cityID string) ([]*Prediction, error) {
-	rows, err := s.db.Query("SELECT * FROM predictions WHERE city_id = $1 ORDER BY forecast_for", cityID)
+func (s *PostgresStore) GetPredictionsByCityID(ctx context.Context, cityID string, q PredictionQuery) ([]*Prediction, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var predictions []*Prediction
+	err := s.StreamPredictionsByCityID(ctx, cityID, q, func(prediction *Prediction) error {
+		predictions = append(predictions, prediction)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer func(rows *sql.Rows) {
+
+	return predictions, nil
+}
+
+// StreamPredictionsByCityID calls fn for each prediction of the city
+// matching q, ordered by forecast_for, as rows are read from the database.
+func (s *PostgresStore) StreamPredictionsByCityID(ctx context.Context, cityID string, q PredictionQuery, fn func(*Prediction) error) error {
+	conditions := []string{"city_id = $1", notDeleted(ctx)}
+	args := []any{cityID}
+	if q.Source != "" {
+		args = append(args, q.Source)
+		conditions = append(conditions, fmt.Sprintf("source = $%d", len(args)))
+	}
+	if q.Model != "" {
+		args = append(args, q.Model)
+		conditions = append(conditions, fmt.Sprintf("model = $%d", len(args)))
+	}
+	if q.IssuedAt != nil {
+		args = append(args, *q.IssuedAt)
+		conditions = append(conditions, fmt.Sprintf("issued_at <= $%d", len(args)))
+	}
+
+	// Keep only the latest issued prediction per source, model and target time
+	query := `
+		SELECT DISTINCT ON (forecast_for, source, COALESCE(model, '')) ` + predictionColumns + `
+		FROM predictions
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY forecast_for, source, COALESCE(model, ''), issued_at DESC, created_at DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer func(rows *tracedRows) {
 		err := rows.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}(rows)
 
-	var predictions []*Prediction
 	for rows.Next() {
 		prediction, err := scanIntoPrediction(rows)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(prediction); err != nil {
+			return err
 		}
-		predictions = append(predictions, prediction)
 	}
 
-	return predictions, nil
+	return rows.Err()
 }
 
-func scanIntoPrediction(rows *sql.Rows) (*Prediction, error) {
+func scanIntoPrediction(rows *tracedRows) (*Prediction, error) {
 	prediction := new(Prediction)
 	err := rows.Scan(
 		&prediction.ID,
@@ -171,7 +324,198 @@ func scanIntoPrediction(rows *sql.Rows) (*Prediction, error) {
 		&prediction.ForecastFor,
 		&prediction.CreatedAt,
 		&prediction.UpdatedAt,
+		&prediction.Source,
+		&prediction.Model,
+		&prediction.IssuedAt,
+		&prediction.DeletedAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	prediction.LeadTimeHours = prediction.ForecastFor.Sub(prediction.IssuedAt).Hours()
+
+	return prediction, nil
+}
+
+func (s *PostgresStore) UpdatePrediction(ctx context.Context, prediction *Prediction) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE predictions 
+		SET city_id = $1, temperature = $2, humidity = $3, forecast_for = $4, source = $5, model = $6, issued_at = $7 
+		WHERE id = $8 AND deleted_at IS NULL
+	`
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		_, err := tx.ExecContext(
+			ctx,
+			query,
+			prediction.CityID,
+			prediction.Temperature,
+			prediction.Humidity,
+			prediction.ForecastFor,
+			prediction.Source,
+			prediction.Model,
+			prediction.IssuedAt,
+			prediction.ID,
+		)
+		return err
+	})
+}
+
+// UpsertPrediction updates the latest issued prediction with the same city,
+// source and forecast_for, or inserts a new one when there is none. It
+// reports whether a new row was created.
+func (s *PostgresStore) UpsertPrediction(ctx context.Context, prediction *Prediction) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var id string
+	created := false
+	err := s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		// Serialize upserts of the same key, there is no unique constraint to
+		// conflict on because older issues of a forecast are kept as history.
+		// The key is formatted here in UTC, as the text of a timestamptz
+		// depends on the TimeZone of the session
+		_, err := tx.ExecContext(
+			ctx,
+			"SELECT pg_advisory_xact_lock(hashtext($1))",
+			prediction.CityID+"|"+prediction.Source+"|"+prediction.ForecastFor.UTC().Format(time.RFC3339Nano),
+		)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			SELECT id FROM predictions 
+			WHERE city_id = $1 AND source = $2 AND forecast_for = $3 AND deleted_at IS NULL
+			ORDER BY issued_at DESC, created_at DESC
+			LIMIT 1
+		`, prediction.CityID, prediction.Source, prediction.ForecastFor).Scan(&id)
+
+		switch {
+		case err == sql.ErrNoRows:
+			created = true
+			return tx.QueryRowContext(ctx, `
+				INSERT INTO predictions (city_id, temperature, humidity, forecast_for, source, model, issued_at) 
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				RETURNING id
+			`,
+				prediction.CityID,
+				prediction.Temperature,
+				prediction.Humidity,
+				prediction.ForecastFor,
+				prediction.Source,
+				prediction.Model,
+				prediction.IssuedAt,
+			).Scan(&id)
+		case err != nil:
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE predictions 
+			SET temperature = $1, humidity = $2, model = $3, issued_at = $4 
+			WHERE id = $5
+		`,
+			prediction.Temperature,
+			prediction.Humidity,
+			prediction.Model,
+			prediction.IssuedAt,
+			id,
+		)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	prediction.ID = id
+	return created, nil
+}
+
+// DeletePrediction marks the prediction deleted, which takes it out of the
+// queries until purged.
+func (s *PostgresStore) DeletePrediction(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE predictions 
+		SET deleted_at = NOW() 
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		result, err := tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return fmt.Errorf("prediction [%s] not found", id)
+		}
+		return nil
+	})
+}
+
+// DeletePredictionsBefore marks deleted the predictions whose forecast_for
+// is older than cutoff, optionally only for one city, and returns how many
+// were deleted.
+func (s *PostgresStore) DeletePredictionsBefore(ctx context.Context, cutoff time.Time, cityID string) (int64, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE predictions 
+		SET deleted_at = NOW() 
+		WHERE forecast_for < $1 AND ($2 = '' OR city_id::text = $2) AND deleted_at IS NULL
+	`
+
+	var deleted int64
+	err := s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		result, err := tx.ExecContext(ctx, query, cutoff, cityID)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	return deleted, err
+}
+
+// PurgeDeletedPredictions deletes for good the predictions deleted before
+// cutoff and returns how many were purged.
+func (s *PostgresStore) PurgeDeletedPredictions(ctx context.Context, cutoff time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Their deletion is already in the audit log
+	_, err = tx.ExecContext(ctx, "SET LOCAL weather.skip_audit = 'on'")
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM predictions 
+		WHERE deleted_at < $1
+	`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
 
-	return prediction, err
+	return purged, tx.Commit()
 }
@@ -2,28 +2,88 @@ package main
 
 import "time"
 
+// Source of the predictions generated by the built-in Forecaster.
+const PredictionSourceEngine = "engine"
+
+// Source assigned to predictions posted without one.
+const PredictionSourceExternal = "external"
+
 type Prediction struct {
-	ID          string     `json:"id"`
+	ID            string     `json:"id"`
+	CityID        string     `json:"city_id"`
+	Temperature   float64    `json:"temperature"`
+	Humidity      float64    `json:"humidity"`
+	ForecastFor   time.Time  `json:"forecast_for"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+	Source        string     `json:"source"`
+	Model         *string    `json:"model,omitempty"`
+	IssuedAt      time.Time  `json:"issued_at"`
+	LeadTimeHours float64    `json:"lead_time_hours"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+type CreatePredictionRequest struct {
 	CityID      string     `json:"city_id"`
 	Temperature float64    `json:"temperature"`
 	Humidity    float64    `json:"humidity"`
 	ForecastFor time.Time  `json:"forecast_for"`
-	CreatedAt   time.Time  `json:"created_at"`
-	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	Source      string     `json:"source"`
+	Model       *string    `json:"model,omitempty"`
+	IssuedAt    *time.Time `json:"issued_at,omitempty"`
 }
 
-type CreatePredictionRequest struct {
-	CityID      string    `json:"city_id"`
-	Temperature float64   `json:"temperature"`
-	Humidity    float64   `json:"humidity"`
-	ForecastFor time.Time `json:"forecast_for"`
+// PredictionBatchError reports why an item of a prediction batch was rejected.
+type PredictionBatchError struct {
+	Index  int    `json:"index"`
+	CityID string `json:"city_id"`
+	Error  string `json:"error"`
 }
 
-func NewPrediction(cityID string, temperature, humidity float64, forecastFor time.Time) (*Prediction, error) {
+// PredictionBatchResponse is returned when a batch contains rejected items,
+// either as the error of an all-or-nothing batch or as the result of a
+// partial one.
+type PredictionBatchResponse struct {
+	Error    string                 `json:"error,omitempty"`
+	Created  []*Prediction          `json:"created"`
+	Rejected []PredictionBatchError `json:"rejected"`
+}
+
+// PredictionQuery narrows the predictions listed for a city. Only the
+// latest issued prediction per source, model and forecast_for is returned;
+// when IssuedAt is set, predictions issued after it are ignored so the
+// forecast can be seen as it was at that time.
+type PredictionQuery struct {
+	Source   string
+	Model    string
+	IssuedAt *time.Time
+}
+
+func NewPrediction(
+	cityID string,
+	temperature, humidity float64,
+	forecastFor time.Time,
+	source string,
+	model *string,
+	issuedAt *time.Time,
+) (*Prediction, error) {
+	if source == "" {
+		source = PredictionSourceExternal
+	}
+
+	issued := time.Now().UTC()
+	if issuedAt != nil {
+		issued = issuedAt.UTC()
+	}
+
 	return &Prediction{
-		CityID:      cityID,
-		Temperature: temperature,
-		Humidity:    humidity,
-		ForecastFor: forecastFor,
+		CityID:        cityID,
+		Temperature:   temperature,
+		Humidity:      humidity,
+		ForecastFor:   forecastFor,
+		Source:        source,
+		Model:         model,
+		IssuedAt:      issued,
+		LeadTimeHours: forecastFor.Sub(issued).Hours(),
 	}, nil
 }
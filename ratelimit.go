@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authorizationHeader carries the API token of the client.
+const authorizationHeader = "Authorization"
+
+// bucketSweepInterval is how often the buckets left full are forgotten.
+const bucketSweepInterval = time.Minute
+
+// RateLimiter limits the request rate of every client IP, and of every
+// device once authenticated, with token buckets. Devices are identified by
+// their API token or verified signature, never by the headers they claim,
+// so that no one can spend the limits of another. Requests changing data,
+// among them the readings sent by the stations, are limited as ingestion
+// and the others as reads, each with their own rates.
+type RateLimiter struct {
+	ingestDevice *tokenBuckets
+	ingestIP     *tokenBuckets
+	readDevice   *tokenBuckets
+	readIP       *tokenBuckets
+
+	trustForwardedFor bool
+}
+
+// NewRateLimiter creates a new instance of RateLimiter. A disabled limiter
+// lets every request through.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if !cfg.Enabled {
+		return &RateLimiter{trustForwardedFor: cfg.TrustForwardedFor}
+	}
+	return &RateLimiter{
+		ingestDevice:      newTokenBuckets(cfg.IngestRate, cfg.IngestBurst),
+		ingestIP:          newTokenBuckets(cfg.IngestIPRate, cfg.IngestIPBurst),
+		readDevice:        newTokenBuckets(cfg.ReadRate, cfg.ReadBurst),
+		readIP:            newTokenBuckets(cfg.ReadIPRate, cfg.ReadIPBurst),
+		trustForwardedFor: cfg.TrustForwardedFor,
+	}
+}
+
+type clientIPKey struct{}
+
+// ClientIPFromContext returns the address of the client of the request ctx
+// belongs to.
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// limitClients is a middleware which answers the requests over the limits
+// of their client IP with http.StatusTooManyRequests and a Retry-After
+// header. It runs before the requests are authenticated, and records the
+// client IP in their context.
+func (l *RateLimiter) limitClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := l.clientIP(r)
+		_, ipBuckets := l.buckets(r)
+		if ok, retryAfter := ipBuckets.take(ip, time.Now()); !ok {
+			tooManyRequests(w, r, retryAfter)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// limitDevices is a middleware which answers the requests over the limits
+// of their device with http.StatusTooManyRequests and a Retry-After header.
+// It must run once the requests are authenticated, see requestDevice.
+func (l *RateLimiter) limitDevices(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceBuckets, _ := l.buckets(r)
+		if ok, retryAfter := deviceBuckets.take(requestDevice(r), time.Now()); !ok {
+			tooManyRequests(w, r, retryAfter)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// buckets returns the device and client IP buckets limiting r.
+func (l *RateLimiter) buckets(r *http.Request) (*tokenBuckets, *tokenBuckets) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return l.readDevice, l.readIP
+	default:
+		return l.ingestDevice, l.ingestIP
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeAPIError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+}
+
+// requestDevice returns who sends r: the ID of its authenticated principal,
+// its API token or its device with a verified signature, or else its client
+// IP.
+func requestDevice(r *http.Request) string {
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		return principal.ID
+	}
+	return "ip:" + ClientIPFromContext(r.Context())
+}
+
+// clientIP returns the address of the client sending r. Behind a reverse
+// proxy trusted to set X-Forwarded-For, it is the address the proxy added
+// last, which the client cannot forge.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.trustForwardedFor {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tokenBuckets holds a token bucket per key, refilled at rate tokens per
+// second up to burst tokens. A nil tokenBuckets has no limit.
+type tokenBuckets struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBuckets creates the buckets allowing perMinute requests per
+// minute with bursts of burst requests, or nil when perMinute is 0.
+func newTokenBuckets(perMinute float64, burst int) *tokenBuckets {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBuckets{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take takes a token from the bucket of key. When the bucket is empty, it
+// returns false and how long until a token is available.
+func (b *tokenBuckets) take(key string, now time.Time) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sweep(now)
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: b.burst, last: now}
+		b.buckets[key] = bucket
+	}
+
+	bucket.tokens = min(b.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / b.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep forgets the buckets which have refilled, as they are the same as
+// new ones, so that the buckets of past clients don't pile up.
+func (b *tokenBuckets) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < bucketSweepInterval {
+		return
+	}
+	b.lastSweep = now
+
+	for key, bucket := range b.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate >= b.burst {
+			delete(b.buckets, key)
+		}
+	}
+}
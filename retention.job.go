@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// RetentionJob periodically enforces the retention policy of every city,
+// falling back to the default windows for cities without their own, and
+// purges the data deleted for longer than the grace period.
+type RetentionJob struct {
+	store       Storage
+	defaults    RetentionPolicy
+	interval    time.Duration
+	gracePeriod time.Duration
+
+	mu    sync.RWMutex
+	stats RetentionStats
+}
+
+// NewRetentionJob creates a new instance of RetentionJob. With a grace
+// period of 0 the deleted data is never purged.
+func NewRetentionJob(store Storage, defaults RetentionPolicy, interval, gracePeriod time.Duration) *RetentionJob {
+	return &RetentionJob{
+		store:       store,
+		defaults:    defaults,
+		interval:    interval,
+		gracePeriod: gracePeriod,
+		stats: RetentionStats{
+			DefaultRawDays:    defaults.RawRetentionDays,
+			DefaultHourlyDays: defaults.HourlyRetentionDays,
+		},
+	}
+}
+
+// Run enforces the retention policies on each interval tick until ctx is done.
+func (j *RetentionJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		// Let a run in progress finish on shutdown
+		if err := j.RunOnce(context.WithoutCancel(ctx)); err != nil {
+			slog.ErrorContext(ctx, "retention run", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce creates the coming weather partitions, prunes the data of every
+// city past its retention windows, purges the expired idempotency keys and
+// device nonces, and the cities, readings and predictions deleted before
+// the grace period.
+func (j *RetentionJob) RunOnce(ctx context.Context) error {
+	start := time.Now()
+	now := start.UTC()
+
+	created, err := j.store.EnsureWeatherPartitions(ctx, now, now.AddDate(0, weatherPartitionsAhead, 0))
+	var dropped, rawPruned, hourlyPruned int64
+	if err == nil {
+		dropped, rawPruned, hourlyPruned, err = j.prune(ctx, now)
+	}
+	var keysPurged, noncesPurged int64
+	if err == nil {
+		keysPurged, err = j.store.DeleteExpiredIdempotencyKeys(ctx, now)
+	}
+	if err == nil {
+		noncesPurged, err = j.store.DeleteExpiredDeviceNonces(ctx, now)
+	}
+	var citiesPurged, readingsPurged, predictionsPurged int64
+	if err == nil && j.gracePeriod > 0 {
+		citiesPurged, readingsPurged, predictionsPurged, err = j.purgeDeleted(ctx, now.Add(-j.gracePeriod))
+	}
+
+	j.mu.Lock()
+	j.stats.Runs++
+	j.stats.LastRunAt = &start
+	j.stats.LastRunDuration = time.Since(start).String()
+	j.stats.LastRawPruned = rawPruned
+	j.stats.LastHourlyPruned = hourlyPruned
+	j.stats.LastPartitionsDropped = dropped
+	j.stats.RawRowsPruned += rawPruned
+	j.stats.HourlyRowsPruned += hourlyPruned
+	j.stats.PartitionsCreated += int64(created)
+	j.stats.PartitionsDropped += dropped
+	j.stats.IdempotencyKeysPurged += keysPurged
+	j.stats.DeviceNoncesPurged += noncesPurged
+	j.stats.CitiesPurged += citiesPurged
+	j.stats.ReadingsPurged += readingsPurged
+	j.stats.PredictionsPurged += predictionsPurged
+	j.stats.LastError = ""
+	if err != nil {
+		j.stats.LastError = err.Error()
+	}
+	j.mu.Unlock()
+
+	if created > 0 {
+		slog.InfoContext(ctx, "retention created weather partitions", "partitions", created)
+	}
+	if dropped > 0 || rawPruned > 0 || hourlyPruned > 0 {
+		slog.InfoContext(ctx, "retention pruned data", "partitions_dropped", dropped, "readings", rawPruned, "hourly_aggregates", hourlyPruned)
+	}
+	if citiesPurged > 0 || readingsPurged > 0 || predictionsPurged > 0 {
+		slog.InfoContext(ctx, "retention purged deleted data", "cities", citiesPurged, "readings", readingsPurged, "predictions", predictionsPurged)
+	}
+
+	return err
+}
+
+// Stats returns the work done by the job so far.
+func (j *RetentionJob) Stats() RetentionStats {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	return j.stats
+}
+
+// Policy returns the policy enforced for the city: its own one if set,
+// the default otherwise.
+func (j *RetentionJob) Policy(ctx context.Context, cityID string) (*RetentionPolicy, error) {
+	policies, err := j.policies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy, ok := policies[cityID]; ok {
+		return policy, nil
+	}
+
+	policy := j.defaults
+	policy.CityID = cityID
+	policy.Default = true
+	return &policy, nil
+}
+
+func (j *RetentionJob) policies(ctx context.Context) (map[string]*RetentionPolicy, error) {
+	policies, err := j.store.GetRetentionPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byCity := make(map[string]*RetentionPolicy, len(policies))
+	for _, policy := range policies {
+		byCity[policy.CityID] = policy
+	}
+	return byCity, nil
+}
+
+func (j *RetentionJob) prune(ctx context.Context, now time.Time) (int64, int64, int64, error) {
+	cities, err := j.store.GetCities(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	policies, err := j.policies(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// The deleted cities keep their readings until purged, under the policy
+	// they had, so that the partitions holding them can still be dropped
+	allCities, err := j.store.GetCities(WithDeleted(ctx))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Cities without a raw retention window keep their readings forever
+	rawCutoffs := make(map[string]time.Time, len(allCities))
+	for _, city := range allCities {
+		policy, ok := policies[city.ID]
+		if !ok {
+			policy = &j.defaults
+		}
+		if policy.RawRetentionDays > 0 {
+			rawCutoffs[city.ID] = retentionCutoff(now, policy.RawRetentionDays)
+		}
+	}
+
+	// Whole months past the cutoff of every city in them are dropped at
+	// once, the rest is deleted row by row below
+	dropped, err := j.dropPartitions(ctx, now, rawCutoffs)
+	if err != nil {
+		return dropped, 0, 0, err
+	}
+
+	var rawPruned, hourlyPruned int64
+	for _, city := range cities {
+		policy, ok := policies[city.ID]
+		if !ok {
+			policy = &j.defaults
+		}
+
+		if cutoff, ok := rawCutoffs[city.ID]; ok {
+			pruned, err := j.store.PruneWeather(ctx, city.ID, cutoff)
+			if err != nil {
+				return dropped, rawPruned, hourlyPruned, err
+			}
+			rawPruned += pruned
+		}
+
+		if policy.HourlyRetentionDays > 0 {
+			pruned, err := j.store.PruneHourlyRollups(ctx, city.ID, retentionCutoff(now, policy.HourlyRetentionDays))
+			if err != nil {
+				return dropped, rawPruned, hourlyPruned, err
+			}
+			hourlyPruned += pruned
+		}
+	}
+
+	return dropped, rawPruned, hourlyPruned, nil
+}
+
+func (j *RetentionJob) dropPartitions(ctx context.Context, now time.Time, rawCutoffs map[string]time.Time) (int64, error) {
+	if len(rawCutoffs) == 0 {
+		return 0, nil
+	}
+
+	partitions, err := j.store.GetWeatherPartitions(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var dropped int64
+	for _, partition := range partitions {
+		// The current and coming months are never dropped, even if empty
+		if partition.To.After(now) {
+			continue
+		}
+
+		cityIDs, err := j.store.GetWeatherPartitionCityIDs(ctx, partition)
+		if err != nil {
+			return dropped, err
+		}
+
+		expired := true
+		for _, cityID := range cityIDs {
+			cutoff, ok := rawCutoffs[cityID]
+			if !ok || partition.To.After(cutoff) {
+				expired = false
+				break
+			}
+		}
+		if !expired {
+			continue
+		}
+
+		if err := j.store.DropWeatherPartition(ctx, partition); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+
+	return dropped, nil
+}
+
+// purgeDeleted deletes for good the cities, readings and predictions
+// deleted before cutoff. Cities go first, with all their data.
+func (j *RetentionJob) purgeDeleted(ctx context.Context, cutoff time.Time) (int64, int64, int64, error) {
+	cities, err := j.store.PurgeDeletedCities(ctx, cutoff)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	readings, err := j.store.PurgeDeletedWeathers(ctx, cutoff)
+	if err != nil {
+		return cities, 0, 0, err
+	}
+
+	predictions, err := j.store.PurgeDeletedPredictions(ctx, cutoff)
+	if err != nil {
+		return cities, readings, 0, err
+	}
+
+	return cities, readings, predictions, nil
+}
+
+// retentionCutoff returns the start of the day days ago. Cutting on whole
+// days keeps every hour and day either fully raw or fully rolled up.
+func retentionCutoff(now time.Time, days int) time.Time {
+	return now.AddDate(0, 0, -days).Truncate(24 * time.Hour)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (server *APIServer) handleGetRetentionStats(w http.ResponseWriter, _ *http.Request) error {
+	return WriteJSON(w, http.StatusOK, server.retention.Stats())
+}
+
+func (server *APIServer) handleGetRetentionPolicies(w http.ResponseWriter, r *http.Request) error {
+	policies, err := server.store.GetRetentionPolicies(r.Context())
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, policies)
+}
+
+func (server *APIServer) handleGetRetentionPolicy(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = server.store.GetCityByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	policy, err := server.retention.Policy(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, policy)
+}
+
+func (server *APIServer) handleUpdateRetentionPolicy(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = server.store.GetCityByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	req := new(UpdateRetentionPolicyRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+
+	policy, err := NewRetentionPolicy(
+		id,
+		req.RawRetentionDays,
+		req.HourlyRetentionDays,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := server.store.UpsertRetentionPolicy(r.Context(), policy); err != nil {
+		return err
+	}
+
+	// Recovering data from DB to get the most up-to-date data
+	updatedPolicy, err := server.store.GetRetentionPolicyByCityID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, updatedPolicy)
+}
+
+func (server *APIServer) handleDeleteRetentionPolicy(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	err = server.store.DeleteRetentionPolicy(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": id})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+func (s *PostgresStore) CreateRetentionTables(ctx context.Context) error {
+	// Hourly and daily aggregates keep sums and counts rather than
+	// averages so they can be merged exactly
+	_, err := s.db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS weather_hourly_rollups (
+            city_id UUID NOT NULL,
+            hour TIMESTAMP NOT NULL,
+            reading_count BIGINT NOT NULL,
+            temperature_sum FLOAT NOT NULL,
+            humidity_sum FLOAT NOT NULL,
+            temperature_min FLOAT NOT NULL,
+            temperature_max FLOAT NOT NULL,
+            humidity_min FLOAT NOT NULL,
+            humidity_max FLOAT NOT NULL,
+            PRIMARY KEY (city_id, hour),
+            FOREIGN KEY (city_id) REFERENCES cities(id)
+        );
+
+        CREATE TABLE IF NOT EXISTS weather_daily_rollups (
+            city_id UUID NOT NULL,
+            day TIMESTAMP NOT NULL,
+            reading_count BIGINT NOT NULL,
+            temperature_sum FLOAT NOT NULL,
+            humidity_sum FLOAT NOT NULL,
+            temperature_min FLOAT NOT NULL,
+            temperature_max FLOAT NOT NULL,
+            humidity_min FLOAT NOT NULL,
+            humidity_max FLOAT NOT NULL,
+            PRIMARY KEY (city_id, day),
+            FOREIGN KEY (city_id) REFERENCES cities(id)
+        );
+
+        CREATE TABLE IF NOT EXISTS retention_policies (
+            city_id UUID PRIMARY KEY,
+            raw_retention_days INTEGER NOT NULL,
+            hourly_retention_days INTEGER NOT NULL DEFAULT 0,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP NULL,
+            FOREIGN KEY (city_id) REFERENCES cities(id)
+        );
+
+        CREATE INDEX IF NOT EXISTS weather_city_id_created_at_idx ON weather (city_id, created_at);
+    `)
+	return err
+}
+
+func (s *PostgresStore) GetRetentionPolicies(ctx context.Context) ([]*RetentionPolicy, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT city_id, raw_retention_days, hourly_retention_days, created_at, updated_at 
+		FROM retention_policies
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var policies []*RetentionPolicy
+	for rows.Next() {
+		policy, err := scanIntoRetentionPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+func (s *PostgresStore) GetRetentionPolicyByCityID(ctx context.Context, cityID string) (*RetentionPolicy, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT city_id, raw_retention_days, hourly_retention_days, created_at, updated_at 
+		FROM retention_policies 
+		WHERE city_id = $1
+	`, cityID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		return scanIntoRetentionPolicy(rows)
+	}
+
+	return nil, fmt.Errorf("retention policy for city [%s] not found", cityID)
+}
+
+func scanIntoRetentionPolicy(rows *tracedRows) (*RetentionPolicy, error) {
+	policy := new(RetentionPolicy)
+	err := rows.Scan(
+		&policy.CityID,
+		&policy.RawRetentionDays,
+		&policy.HourlyRetentionDays,
+		&policy.CreatedAt,
+		&policy.UpdatedAt,
+	)
+
+	return policy, err
+}
+
+func (s *PostgresStore) UpsertRetentionPolicy(ctx context.Context, policy *RetentionPolicy) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO retention_policies (city_id, raw_retention_days, hourly_retention_days) 
+		VALUES ($1, $2, $3)
+		ON CONFLICT (city_id) DO UPDATE 
+		SET raw_retention_days = EXCLUDED.raw_retention_days, 
+			hourly_retention_days = EXCLUDED.hourly_retention_days, 
+			updated_at = NOW()
+	`
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		_, err := tx.ExecContext(
+			ctx,
+			query,
+			policy.CityID,
+			policy.RawRetentionDays,
+			policy.HourlyRetentionDays,
+		)
+		return err
+	})
+}
+
+func (s *PostgresStore) DeleteRetentionPolicy(ctx context.Context, cityID string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		DELETE FROM retention_policies 
+		WHERE city_id = $1
+	`
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		_, err := tx.ExecContext(ctx, query, cityID)
+		return err
+	})
+}
+
+// PruneWeather deletes the readings of a city older than cutoff, leaving
+// the hourly aggregates untouched. It returns the number of readings
+// deleted.
+func (s *PostgresStore) PruneWeather(ctx context.Context, cityID string, cutoff time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Keep the rollup triggers from taking the readings out of the aggregates,
+	// and the pruned readings out of the audit log
+	_, err = tx.ExecContext(ctx, "SET LOCAL weather.skip_rollup = 'on'; SET LOCAL weather.skip_audit = 'on'")
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM weather 
+		WHERE city_id = $1 AND created_at < $2
+	`, cityID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return pruned, tx.Commit()
+}
+
+// PruneHourlyRollups rolls the hourly aggregates of a city older than
+// cutoff up into the daily aggregates and deletes them, in one
+// transaction. It returns the number of hourly aggregates deleted.
+func (s *PostgresStore) PruneHourlyRollups(ctx context.Context, cityID string, cutoff time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO weather_daily_rollups AS r (
+			city_id, day, reading_count, temperature_sum, humidity_sum,
+			temperature_min, temperature_max, humidity_min, humidity_max
+		)
+		SELECT 
+			city_id,
+			date_trunc('day', hour),
+			SUM(reading_count),
+			SUM(temperature_sum),
+			SUM(humidity_sum),
+			MIN(temperature_min),
+			MAX(temperature_max),
+			MIN(humidity_min),
+			MAX(humidity_max)
+		FROM weather_hourly_rollups
+		WHERE city_id = $1 AND hour < $2
+		GROUP BY city_id, date_trunc('day', hour)
+		ON CONFLICT (city_id, day) DO UPDATE 
+		SET reading_count = r.reading_count + EXCLUDED.reading_count,
+			temperature_sum = r.temperature_sum + EXCLUDED.temperature_sum,
+			humidity_sum = r.humidity_sum + EXCLUDED.humidity_sum,
+			temperature_min = LEAST(r.temperature_min, EXCLUDED.temperature_min),
+			temperature_max = GREATEST(r.temperature_max, EXCLUDED.temperature_max),
+			humidity_min = LEAST(r.humidity_min, EXCLUDED.humidity_min),
+			humidity_max = GREATEST(r.humidity_max, EXCLUDED.humidity_max)
+	`, cityID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM weather_hourly_rollups 
+		WHERE city_id = $1 AND hour < $2
+	`, cityID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return pruned, tx.Commit()
+}
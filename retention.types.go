@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetentionPolicy defines how long the data of a city is kept. Raw
+// readings older than RawRetentionDays are rolled up into hourly
+// aggregates and deleted; hourly aggregates older than
+// HourlyRetentionDays are rolled up into daily aggregates and deleted.
+// Zero keeps the data forever.
+type RetentionPolicy struct {
+	CityID              string     `json:"city_id"`
+	RawRetentionDays    int        `json:"raw_retention_days"`
+	HourlyRetentionDays int        `json:"hourly_retention_days"`
+	Default             bool       `json:"default,omitempty"`
+	CreatedAt           *time.Time `json:"created_at,omitempty"`
+	UpdatedAt           *time.Time `json:"updated_at,omitempty"`
+}
+
+type UpdateRetentionPolicyRequest struct {
+	RawRetentionDays    int `json:"raw_retention_days"`
+	HourlyRetentionDays int `json:"hourly_retention_days"`
+}
+
+func NewRetentionPolicy(cityID string, rawRetentionDays, hourlyRetentionDays int) (*RetentionPolicy, error) {
+	policy := &RetentionPolicy{
+		CityID:              cityID,
+		RawRetentionDays:    rawRetentionDays,
+		HourlyRetentionDays: hourlyRetentionDays,
+	}
+	return policy, policy.Validate()
+}
+
+// Validate checks that the retention windows are usable: hourly
+// aggregates must outlive the raw readings they are built from.
+func (p *RetentionPolicy) Validate() error {
+	if p.RawRetentionDays < 0 || p.HourlyRetentionDays < 0 {
+		return fmt.Errorf("retention days must not be negative")
+	}
+	if p.HourlyRetentionDays > 0 && (p.RawRetentionDays == 0 || p.HourlyRetentionDays < p.RawRetentionDays) {
+		return fmt.Errorf("hourly_retention_days must be at least raw_retention_days, which must not be 0")
+	}
+	return nil
+}
+
+// RetentionStats reports the work done by the RetentionJob since start.
+type RetentionStats struct {
+	Runs                  int64      `json:"runs"`
+	LastRunAt             *time.Time `json:"last_run_at,omitempty"`
+	LastRunDuration       string     `json:"last_run_duration,omitempty"`
+	LastError             string     `json:"last_error,omitempty"`
+	RawRowsPruned         int64      `json:"raw_rows_pruned"`
+	HourlyRowsPruned      int64      `json:"hourly_rows_pruned"`
+	LastRawPruned         int64      `json:"last_raw_rows_pruned"`
+	LastHourlyPruned      int64      `json:"last_hourly_rows_pruned"`
+	PartitionsCreated     int64      `json:"partitions_created"`
+	PartitionsDropped     int64      `json:"partitions_dropped"`
+	LastPartitionsDropped int64      `json:"last_partitions_dropped"`
+	IdempotencyKeysPurged int64      `json:"idempotency_keys_purged"`
+	DeviceNoncesPurged    int64      `json:"device_nonces_purged"`
+	CitiesPurged          int64      `json:"deleted_cities_purged"`
+	ReadingsPurged        int64      `json:"deleted_readings_purged"`
+	PredictionsPurged     int64      `json:"deleted_predictions_purged"`
+	DefaultRawDays        int        `json:"default_raw_retention_days"`
+	DefaultHourlyDays     int        `json:"default_hourly_retention_days"`
+}
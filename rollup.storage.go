@@ -0,0 +1,230 @@
+package main
+
+import "context"
+
+// CreateHourlyRollupTriggers keeps weather_hourly_rollups in sync with the
+// weather table. The triggers run once per statement over the transition
+// tables, so batch inserts and COPY update each hour once. Deleted readings
+// are left out, so deleting one takes it out of its hour and restoring it
+// puts it back. Existing readings are rolled up the first time the triggers
+// are installed.
+func (s *PostgresStore) CreateHourlyRollupTriggers(ctx context.Context) error {
+	// The function is replaced on every start so existing databases pick up
+	// changes. Retention sets weather.skip_rollup while pruning so pruned
+	// readings stay in the aggregates
+	_, err := s.db.ExecContext(ctx, `
+        CREATE OR REPLACE FUNCTION rollup_weather()
+        RETURNS TRIGGER AS $$
+        BEGIN
+            IF current_setting('weather.skip_rollup', true) = 'on' THEN
+                RETURN NULL;
+            END IF;
+
+            -- Take the previous values out of their hours
+            IF TG_OP IN ('UPDATE', 'DELETE') THEN
+                UPDATE weather_hourly_rollups r
+                SET reading_count = r.reading_count - o.reading_count,
+                    temperature_sum = r.temperature_sum - o.temperature_sum,
+                    humidity_sum = r.humidity_sum - o.humidity_sum
+                FROM (
+                    SELECT 
+                        city_id,
+                        date_trunc('hour', created_at) AS hour,
+                        COUNT(*) AS reading_count,
+                        SUM(temperature) AS temperature_sum,
+                        SUM(humidity) AS humidity_sum
+                    FROM old_rows
+                    WHERE deleted_at IS NULL
+                    GROUP BY 1, 2
+                ) o
+                WHERE r.city_id = o.city_id AND r.hour = o.hour;
+            END IF;
+
+            -- Add the new values to their hours
+            IF TG_OP IN ('INSERT', 'UPDATE') THEN
+                INSERT INTO weather_hourly_rollups AS r (
+                    city_id, hour, reading_count, temperature_sum, humidity_sum,
+                    temperature_min, temperature_max, humidity_min, humidity_max
+                )
+                SELECT 
+                    city_id,
+                    date_trunc('hour', created_at),
+                    COUNT(*),
+                    SUM(temperature),
+                    SUM(humidity),
+                    MIN(temperature),
+                    MAX(temperature),
+                    MIN(humidity),
+                    MAX(humidity)
+                FROM new_rows
+                WHERE deleted_at IS NULL
+                GROUP BY 1, 2
+                ON CONFLICT (city_id, hour) DO UPDATE 
+                SET reading_count = r.reading_count + EXCLUDED.reading_count,
+                    temperature_sum = r.temperature_sum + EXCLUDED.temperature_sum,
+                    humidity_sum = r.humidity_sum + EXCLUDED.humidity_sum,
+                    temperature_min = LEAST(r.temperature_min, EXCLUDED.temperature_min),
+                    temperature_max = GREATEST(r.temperature_max, EXCLUDED.temperature_max),
+                    humidity_min = LEAST(r.humidity_min, EXCLUDED.humidity_min),
+                    humidity_max = GREATEST(r.humidity_max, EXCLUDED.humidity_max);
+            END IF;
+
+            -- Minimums and maximums can't be taken out, so the hours that
+            -- lost readings get them again from the remaining ones
+            IF TG_OP IN ('UPDATE', 'DELETE') THEN
+                DELETE FROM weather_hourly_rollups r
+                USING (SELECT DISTINCT city_id, date_trunc('hour', created_at) AS hour FROM old_rows WHERE deleted_at IS NULL) o
+                WHERE r.city_id = o.city_id AND r.hour = o.hour AND r.reading_count <= 0;
+
+                UPDATE weather_hourly_rollups r
+                SET temperature_min = w.temperature_min,
+                    temperature_max = w.temperature_max,
+                    humidity_min = w.humidity_min,
+                    humidity_max = w.humidity_max
+                FROM (
+                    SELECT 
+                        w.city_id,
+                        o.hour,
+                        MIN(w.temperature) AS temperature_min,
+                        MAX(w.temperature) AS temperature_max,
+                        MIN(w.humidity) AS humidity_min,
+                        MAX(w.humidity) AS humidity_max
+                    FROM weather w
+                    JOIN (SELECT DISTINCT city_id, date_trunc('hour', created_at) AS hour FROM old_rows WHERE deleted_at IS NULL) o
+                        ON w.city_id = o.city_id
+                        AND w.created_at >= o.hour
+                        AND w.created_at < o.hour + INTERVAL '1 hour'
+                    WHERE w.deleted_at IS NULL
+                    GROUP BY 1, 2
+                ) w
+                WHERE r.city_id = w.city_id AND r.hour = w.hour;
+            END IF;
+
+            RETURN NULL;
+        END;
+        $$ LANGUAGE plpgsql;
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Check if the triggers already exist
+	var triggerExists bool
+	err = s.db.QueryRowContext(ctx, `
+        SELECT EXISTS(
+            SELECT 1 FROM pg_trigger 
+            WHERE tgname = 'weather_rollup_insert_trigger' 
+            AND tgrelid = 'weather'::regclass)
+    `).Scan(&triggerExists)
+	if err != nil {
+		return err
+	}
+
+	if triggerExists {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Transition tables can only be used by single event triggers
+	_, err = tx.ExecContext(ctx, `
+        CREATE TRIGGER weather_rollup_insert_trigger
+        AFTER INSERT ON weather
+        REFERENCING NEW TABLE AS new_rows
+        FOR EACH STATEMENT
+        EXECUTE FUNCTION rollup_weather();
+
+        CREATE TRIGGER weather_rollup_update_trigger
+        AFTER UPDATE ON weather
+        REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows
+        FOR EACH STATEMENT
+        EXECUTE FUNCTION rollup_weather();
+
+        CREATE TRIGGER weather_rollup_delete_trigger
+        AFTER DELETE ON weather
+        REFERENCING OLD TABLE AS old_rows
+        FOR EACH STATEMENT
+        EXECUTE FUNCTION rollup_weather();
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Roll up the readings stored before the triggers existed
+	if _, err := rebuildHourlyRollups(ctx, tx, ""); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RebuildHourlyRollups recomputes the hourly aggregates of the city, or of
+// every city when cityID is empty, from the readings which aren't
+// deleted. Hours before the oldest reading of a city only exist as
+// aggregates once pruned, so they are kept. It returns the number of hours
+// rebuilt.
+func (s *PostgresStore) RebuildHourlyRollups(ctx context.Context, cityID string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rebuilt, err := rebuildHourlyRollups(ctx, tx, cityID)
+	if err != nil {
+		return 0, err
+	}
+
+	return rebuilt, tx.Commit()
+}
+
+func rebuildHourlyRollups(ctx context.Context, tx *tracedTx, cityID string) (int64, error) {
+	// Hold writers off so no reading is counted twice or missed
+	_, err := tx.ExecContext(ctx, "LOCK TABLE weather IN SHARE MODE")
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM weather_hourly_rollups r
+		USING (
+			SELECT city_id, date_trunc('hour', MIN(created_at)) AS since
+			FROM weather
+			WHERE $1 = '' OR city_id::text = $1
+			GROUP BY city_id
+		) f
+		WHERE r.city_id = f.city_id AND r.hour >= f.since
+	`, cityID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO weather_hourly_rollups (
+			city_id, hour, reading_count, temperature_sum, humidity_sum,
+			temperature_min, temperature_max, humidity_min, humidity_max
+		)
+		SELECT 
+			city_id,
+			date_trunc('hour', created_at),
+			COUNT(*),
+			SUM(temperature),
+			SUM(humidity),
+			MIN(temperature),
+			MAX(temperature),
+			MIN(humidity),
+			MAX(humidity)
+		FROM weather
+		WHERE ($1 = '' OR city_id::text = $1) AND deleted_at IS NULL
+		GROUP BY 1, 2
+	`, cityID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
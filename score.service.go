@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+func (server *APIServer) handleEvaluatePredictions(w http.ResponseWriter, r *http.Request) error {
+	cityID := r.URL.Query().Get("city_id")
+	if cityID == "" {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "city_id is required"})
+	}
+
+	now := time.Now().UTC()
+	to, err := getTimeParam(r, "to", now)
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	from, err := getTimeParam(r, "from", to.Add(-7*24*time.Hour))
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if !from.Before(to) {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "from must be before to"})
+	}
+
+	// Verify the city exists
+	_, err = server.store.GetCityByID(r.Context(), cityID)
+	if err != nil {
+		return err
+	}
+
+	scores, err := server.store.EvaluatePredictions(r.Context(), cityID, from, to)
+	if err != nil {
+		return err
+	}
+
+	if len(scores) > 0 {
+		if err := server.store.CreateForecastScores(r.Context(), scores); err != nil {
+			return err
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, scores)
+}
+
+func (server *APIServer) handleGetForecastScores(w http.ResponseWriter, r *http.Request) error {
+	cityID := r.URL.Query().Get("city_id")
+	if cityID == "" {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "city_id is required"})
+	}
+
+	scores, err := server.store.GetForecastScoresByCityID(r.Context(), cityID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, scores)
+}
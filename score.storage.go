@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+func (s *PostgresStore) CreateForecastScoreTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS forecast_scores (
+            id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+            city_id UUID NOT NULL,
+            source TEXT NOT NULL,
+            model TEXT NOT NULL,
+            lead_hours INTEGER NULL,
+            samples INTEGER NOT NULL,
+            temperature_mae FLOAT,
+            temperature_rmse FLOAT,
+            temperature_bias FLOAT,
+            humidity_mae FLOAT,
+            humidity_rmse FLOAT,
+            humidity_bias FLOAT,
+            window_start TIMESTAMP NOT NULL,
+            window_end TIMESTAMP NOT NULL,
+            evaluated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (city_id) REFERENCES cities(id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Scores stored before predictions had a source
+	_, err = s.db.ExecContext(ctx, `ALTER TABLE forecast_scores ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'external'`)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+        CREATE INDEX IF NOT EXISTS forecast_scores_city_id_evaluated_at_idx 
+        ON forecast_scores (city_id, evaluated_at)
+    `)
+	return err
+}
+
+// EvaluatePredictions compares the predictions of a city whose forecast_for
+// falls in [from, to) with the observed hourly averages of the same hour.
+// Errors are grouped by source, model and lead time, plus one summary row
+// per source and model. Lead time is counted from the issue time.
+func (s *PostgresStore) EvaluatePredictions(ctx context.Context, cityID string, from, to time.Time) ([]*ForecastScore, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		WITH observed AS (
+			SELECT 
+				hour,
+				SUM(temperature_sum) / SUM(reading_count) AS temperature,
+				SUM(humidity_sum) / SUM(reading_count) AS humidity
+			FROM (` + hourlyTotalsQuery + `) totals
+			WHERE hour >= date_trunc('hour', $2::timestamp) AND hour < $3
+			GROUP BY hour
+		), paired AS (
+			SELECT 
+				p.source,
+				COALESCE(p.model, '') AS model,
+				FLOOR(EXTRACT(EPOCH FROM (p.forecast_for - p.issued_at)) / 3600)::INTEGER AS lead_hours,
+				p.temperature - o.temperature AS temperature_error,
+				p.humidity - o.humidity AS humidity_error
+			FROM predictions p
+			JOIN observed o ON o.hour = date_trunc('hour', p.forecast_for)
+			WHERE p.city_id = $1 AND p.forecast_for >= $2 AND p.forecast_for < $3 AND p.deleted_at IS NULL
+		)
+		SELECT 
+			source,
+			model,
+			lead_hours,
+			COUNT(*) AS samples,
+			AVG(ABS(temperature_error)),
+			SQRT(AVG(temperature_error ^ 2)),
+			AVG(temperature_error),
+			AVG(ABS(humidity_error)),
+			SQRT(AVG(humidity_error ^ 2)),
+			AVG(humidity_error)
+		FROM paired
+		GROUP BY GROUPING SETS ((source, model, lead_hours), (source, model))
+		ORDER BY source, model, lead_hours NULLS FIRST
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, cityID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var scores []*ForecastScore
+	for rows.Next() {
+		score := &ForecastScore{
+			CityID:      cityID,
+			WindowStart: from,
+			WindowEnd:   to,
+		}
+		var temperatureMAE, temperatureRMSE, temperatureBias sql.NullFloat64
+		var humidityMAE, humidityRMSE, humidityBias sql.NullFloat64
+		err := rows.Scan(
+			&score.Source,
+			&score.Model,
+			&score.LeadHours,
+			&score.Samples,
+			&temperatureMAE,
+			&temperatureRMSE,
+			&temperatureBias,
+			&humidityMAE,
+			&humidityRMSE,
+			&humidityBias,
+		)
+		if err != nil {
+			return nil, err
+		}
+		score.TemperatureMAE = temperatureMAE.Float64
+		score.TemperatureRMSE = temperatureRMSE.Float64
+		score.TemperatureBias = temperatureBias.Float64
+		score.HumidityMAE = humidityMAE.Float64
+		score.HumidityRMSE = humidityRMSE.Float64
+		score.HumidityBias = humidityBias.Float64
+		scores = append(scores, score)
+	}
+
+	return scores, nil
+}
+
+func (s *PostgresStore) CreateForecastScores(ctx context.Context, scores []*ForecastScore) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO forecast_scores (
+			city_id, source, model, lead_hours, samples,
+			temperature_mae, temperature_rmse, temperature_bias,
+			humidity_mae, humidity_rmse, humidity_bias,
+			window_start, window_end
+		) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id, evaluated_at
+	`
+
+	for _, score := range scores {
+		err := tx.QueryRowContext(
+			ctx,
+			query,
+			score.CityID,
+			score.Source,
+			score.Model,
+			score.LeadHours,
+			score.Samples,
+			score.TemperatureMAE,
+			score.TemperatureRMSE,
+			score.TemperatureBias,
+			score.HumidityMAE,
+			score.HumidityRMSE,
+			score.HumidityBias,
+			score.WindowStart,
+			score.WindowEnd,
+		).Scan(&score.ID, &score.EvaluatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetForecastScoresByCityID returns the scores of the most recent
+// evaluation of each source and model for the city.
+func (s *PostgresStore) GetForecastScoresByCityID(ctx context.Context, cityID string) ([]*ForecastScore, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT 
+			id, city_id, source, model, lead_hours, samples,
+			temperature_mae, temperature_rmse, temperature_bias,
+			humidity_mae, humidity_rmse, humidity_bias,
+			window_start, window_end, evaluated_at
+		FROM forecast_scores f
+		WHERE city_id = $1 AND evaluated_at = (
+			SELECT MAX(evaluated_at) FROM forecast_scores 
+			WHERE city_id = f.city_id AND source = f.source AND model = f.model
+		)
+		ORDER BY source, model, lead_hours NULLS FIRST
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, cityID)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var scores []*ForecastScore
+	for rows.Next() {
+		score := new(ForecastScore)
+		err := rows.Scan(
+			&score.ID,
+			&score.CityID,
+			&score.Source,
+			&score.Model,
+			&score.LeadHours,
+			&score.Samples,
+			&score.TemperatureMAE,
+			&score.TemperatureRMSE,
+			&score.TemperatureBias,
+			&score.HumidityMAE,
+			&score.HumidityRMSE,
+			&score.HumidityBias,
+			&score.WindowStart,
+			&score.WindowEnd,
+			&score.EvaluatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		scores = append(scores, score)
+	}
+
+	return scores, nil
+}
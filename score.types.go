@@ -0,0 +1,23 @@
+package main
+
+import "time"
+
+// ForecastScore holds the error of a forecast source and model against
+// observed hourly averages. LeadHours is nil for the summary over all lead times.
+type ForecastScore struct {
+	ID              string    `json:"id"`
+	CityID          string    `json:"city_id"`
+	Source          string    `json:"source"`
+	Model           string    `json:"model"`
+	LeadHours       *int      `json:"lead_hours"`
+	Samples         int       `json:"samples"`
+	TemperatureMAE  float64   `json:"temperature_mae"`
+	TemperatureRMSE float64   `json:"temperature_rmse"`
+	TemperatureBias float64   `json:"temperature_bias"`
+	HumidityMAE     float64   `json:"humidity_mae"`
+	HumidityRMSE    float64   `json:"humidity_rmse"`
+	HumidityBias    float64   `json:"humidity_bias"`
+	WindowStart     time.Time `json:"window_start"`
+	WindowEnd       time.Time `json:"window_end"`
+	EvaluatedAt     time.Time `json:"evaluated_at"`
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// includeDeletedParam is the query parameter by which admins list the
+// deleted cities, readings and predictions along with the others.
+const includeDeletedParam = "include_deleted"
+
+type includeDeletedKey struct{}
+
+// WithDeleted returns a copy of ctx in which the queries of the store
+// include the deleted rows.
+func WithDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeDeletedKey{}, true)
+}
+
+// notDeleted returns the condition keeping the rows which aren't deleted,
+// unless ctx includes the deleted ones.
+func notDeleted(ctx context.Context) string {
+	if included, _ := ctx.Value(includeDeletedKey{}).(bool); included {
+		return "TRUE"
+	}
+	return "deleted_at IS NULL"
+}
+
+// includeDeleted is a middleware which lets the GET requests of admins
+// include the deleted rows with ?include_deleted=true. Other roles are
+// answered with http.StatusForbidden.
+func includeDeleted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get(includeDeletedParam)
+		if r.Method != http.MethodGet || value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		include, err := strconv.ParseBool(value)
+		if err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, includeDeletedParam+" must be true or false")
+			return
+		}
+		if !include {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Without access control there is no principal and no restriction
+		if principal, ok := PrincipalFromContext(r.Context()); ok && !RoleCan(principal.Role, PermissionAdmin) {
+			writeAPIError(w, r, http.StatusForbidden, includeDeletedParam+" is reserved to admins")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithDeleted(r.Context())))
+	})
+}
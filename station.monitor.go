@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stationEventBuffer bounds the events of observed readings waiting to be
+// notified.
+const stationEventBuffer = 64
+
+// StationMonitor keeps track of the most recent reading per city, and per
+// device of the city for the stations sending their X-Device-ID, and
+// notifies when a station goes silent for longer than staleAfter, and
+// again when it starts reporting. Devices are only known from the readings
+// observed since the start.
+type StationMonitor struct {
+	store      Storage
+	notifier   Notifier
+	staleAfter time.Duration
+	interval   time.Duration
+
+	// Events of observed readings, notified by Run so that ingestion never
+	// waits on the notifier
+	events chan StationEvent
+
+	mu       sync.RWMutex
+	stations map[string]*StationStatus
+}
+
+// stationKey returns the key of the station of a city, or of one of its
+// devices when deviceID is set.
+func stationKey(cityID, deviceID string) string {
+	if deviceID == "" {
+		return cityID
+	}
+	return cityID + "|" + deviceID
+}
+
+// NewStationMonitor creates a new instance of StationMonitor.
+func NewStationMonitor(store Storage, notifier Notifier, staleAfter, interval time.Duration) *StationMonitor {
+	return &StationMonitor{
+		store:      store,
+		notifier:   notifier,
+		staleAfter: staleAfter,
+		interval:   interval,
+		events:     make(chan StationEvent, stationEventBuffer),
+		stations:   make(map[string]*StationStatus),
+	}
+}
+
+// Run checks every station on each interval tick, and notifies the events
+// of the observed readings, until ctx is done.
+func (m *StationMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	// Let a run in progress finish on shutdown
+	check := func() {
+		if err := m.Check(context.WithoutCancel(ctx)); err != nil {
+			slog.ErrorContext(ctx, "station monitor check", "error", err)
+		}
+	}
+
+	check()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		case event := <-m.events:
+			m.notify(ctx, []StationEvent{event})
+		}
+	}
+}
+
+// Check reloads the last reading time of every city from the store and
+// fires events for stations, of the cities and their devices, whose state
+// changed.
+func (m *StationMonitor) Check(ctx context.Context) error {
+	latest, err := m.store.GetStationsLastSeen(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var events []StationEvent
+
+	m.mu.Lock()
+	seen := make(map[string]bool, len(latest))
+	for _, l := range latest {
+		seen[l.CityID] = true
+
+		station, ok := m.stations[l.CityID]
+		if !ok {
+			station = &StationStatus{CityID: l.CityID}
+			m.stations[l.CityID] = station
+		}
+		station.CityName = l.CityName
+		if l.LastSeenAt != nil && (station.LastSeenAt == nil || l.LastSeenAt.After(*station.LastSeenAt)) {
+			station.LastSeenAt = l.LastSeenAt
+		}
+
+		if event, changed := m.evaluate(station, now); changed {
+			events = append(events, event)
+		}
+	}
+
+	// Forget cities that no longer exist, with their devices
+	for key, station := range m.stations {
+		if !seen[station.CityID] {
+			delete(m.stations, key)
+			continue
+		}
+		if station.DeviceID == "" {
+			continue
+		}
+		station.CityName = m.stations[station.CityID].CityName
+		if event, changed := m.evaluate(station, now); changed {
+			events = append(events, event)
+		}
+	}
+	m.mu.Unlock()
+
+	m.notify(ctx, events)
+	return nil
+}
+
+// Observe records a freshly stored reading, sent by the device deviceID if
+// set, so a recovering station is reported right away instead of on the
+// next tick. The events are queued for Run without waiting, and dropped
+// with a log line when the queue is full.
+func (m *StationMonitor) Observe(ctx context.Context, weather *Weather, deviceID string) {
+	now := time.Now()
+	var events []StationEvent
+
+	m.mu.Lock()
+	city, ok := m.stations[weather.CityID]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	stations := []*StationStatus{city}
+	if deviceID != "" {
+		key := stationKey(weather.CityID, deviceID)
+		device, ok := m.stations[key]
+		if !ok {
+			device = &StationStatus{CityID: city.CityID, CityName: city.CityName, DeviceID: deviceID}
+			m.stations[key] = device
+		}
+		stations = append(stations, device)
+	}
+	for _, station := range stations {
+		if station.LastSeenAt == nil || weather.CreatedAt.After(*station.LastSeenAt) {
+			createdAt := weather.CreatedAt
+			station.LastSeenAt = &createdAt
+		}
+		if event, changed := m.evaluate(station, now); changed {
+			events = append(events, event)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, event := range events {
+		select {
+		case m.events <- event:
+		default:
+			slog.WarnContext(ctx, "station monitor dropping event, too many events queued", "event", event.Type, "city_id", event.CityID, "device_id", event.DeviceID)
+		}
+	}
+}
+
+// Stations returns a snapshot of the state of every known station.
+func (m *StationMonitor) Stations() []StationStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stations := make([]StationStatus, 0, len(m.stations))
+	for _, station := range m.stations {
+		stations = append(stations, *station)
+	}
+	sort.Slice(stations, func(i, j int) bool {
+		if stations[i].CityName != stations[j].CityName {
+			return stations[i].CityName < stations[j].CityName
+		}
+		return stations[i].DeviceID < stations[j].DeviceID
+	})
+	return stations
+}
+
+// Station returns the state of the station of a city.
+func (m *StationMonitor) Station(cityID string) (StationStatus, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	station, ok := m.stations[cityID]
+	if !ok {
+		return StationStatus{}, false
+	}
+	return *station, true
+}
+
+// evaluate updates the stale flag of the station and reports whether it
+// flipped. Stations that never sent a reading are not considered stale.
+// Callers must hold m.mu.
+func (m *StationMonitor) evaluate(station *StationStatus, now time.Time) (StationEvent, bool) {
+	if station.LastSeenAt == nil {
+		return StationEvent{}, false
+	}
+
+	silence := now.Sub(*station.LastSeenAt)
+	stale := silence > m.staleAfter
+	if stale == station.Stale {
+		return StationEvent{}, false
+	}
+
+	station.Stale = stale
+	event := StationEvent{
+		CityID:     station.CityID,
+		CityName:   station.CityName,
+		DeviceID:   station.DeviceID,
+		LastSeenAt: station.LastSeenAt,
+		Silence:    silence.Truncate(time.Second).String(),
+		At:         now,
+	}
+	if stale {
+		staleSince := station.LastSeenAt.Add(m.staleAfter)
+		station.StaleSince = &staleSince
+		event.Type = StationEventStale
+	} else {
+		station.StaleSince = nil
+		event.Type = StationEventRecovered
+	}
+
+	return event, true
+}
+
+func (m *StationMonitor) notify(ctx context.Context, events []StationEvent) {
+	for _, event := range events {
+		if err := m.notifier.Notify(event); err != nil {
+			slog.ErrorContext(ctx, "station monitor notifying", "event", event.Type, "city_id", event.CityID, "device_id", event.DeviceID, "error", err)
+		}
+	}
+}
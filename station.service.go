@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+func (server *APIServer) handleGetStations(w http.ResponseWriter, r *http.Request) error {
+	staleOnly := r.URL.Query().Get("stale") == "true"
+
+	stations := server.monitor.Stations()
+	if !staleOnly {
+		return WriteJSON(w, http.StatusOK, stations)
+	}
+
+	staleStations := make([]StationStatus, 0, len(stations))
+	for _, station := range stations {
+		if station.Stale {
+			staleStations = append(staleStations, station)
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, staleStations)
+}
+
+func (server *APIServer) handleGetStationByID(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	station, ok := server.monitor.Station(id)
+	if !ok {
+		return fmt.Errorf("station [%s] not found", id)
+	}
+
+	return WriteJSON(w, http.StatusOK, station)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+func (s *PostgresStore) GetStationsLastSeen(ctx context.Context) ([]*StationStatus, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT c.id, c.name, MAX(w.created_at) AS last_seen_at
+		FROM cities c
+		LEFT JOIN weather w ON w.city_id = c.id AND w.deleted_at IS NULL
+		WHERE c.deleted_at IS NULL
+		GROUP BY c.id, c.name
+		ORDER BY c.name
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var stations []*StationStatus
+	for rows.Next() {
+		station := new(StationStatus)
+		err := rows.Scan(
+			&station.CityID,
+			&station.CityName,
+			&station.LastSeenAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		stations = append(stations, station)
+	}
+
+	return stations, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "time"
+
+// StationEvent types fired by the StationMonitor.
+const (
+	StationEventStale     = "station_stale"
+	StationEventRecovered = "station_recovered"
+)
+
+type StationStatus struct {
+	CityID     string     `json:"city_id"`
+	CityName   string     `json:"city_name"`
+	DeviceID   string     `json:"device_id,omitempty"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	Stale      bool       `json:"stale"`
+	StaleSince *time.Time `json:"stale_since,omitempty"`
+}
+
+type StationEvent struct {
+	Type       string     `json:"type"`
+	CityID     string     `json:"city_id"`
+	CityName   string     `json:"city_name"`
+	DeviceID   string     `json:"device_id,omitempty"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	Silence    string     `json:"silence,omitempty"`
+	At         time.Time  `json:"at"`
+}
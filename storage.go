@@ -1,52 +1,174 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	_ "github.com/lib/pq"
+	"iter"
+	"time"
 )
 
 type Storage interface {
 	// Weather operations
-	CreateWeather(weather *Weather) error
-	GetWeatherByID(id string) (*Weather, error)
-	GetWeathers() ([]*Weather, error)
-	GetWeathersByCityID(cityID string) ([]*Weather, error)
-	UpdateWeather(weather *Weather) error
-	DeleteWeather(id string) error
-	GetHourlyAveragesByCityID(cityID string) ([]map[string]interface{}, error)
+	CreateWeather(ctx context.Context, weather *Weather) error
+	CreateIdempotentWeather(ctx context.Context, weather *Weather, key *IdempotencyKey) error
+	CopyWeathers(ctx context.Context, weathers iter.Seq2[*Weather, error]) (int64, error)
+	GetWeatherByID(ctx context.Context, id string) (*Weather, error)
+	GetWeathers(ctx context.Context) ([]*Weather, error)
+	GetWeathersByCityID(ctx context.Context, cityID string) ([]*Weather, error)
+	StreamWeathers(ctx context.Context, q WeatherQuery, fn func(*Weather) error) error
+	UpdateWeather(ctx context.Context, weather *Weather) error
+	DeleteWeather(ctx context.Context, id string) error
+	PurgeDeletedWeathers(ctx context.Context, cutoff time.Time) (int64, error)
+	GetHourlyAveragesByCityID(ctx context.Context, cityID string) ([]map[string]interface{}, error)
+	GetHourlySeriesByCityID(ctx context.Context, cityID string, since time.Time) ([]*HourlyAverage, error)
+	StreamHourlyAveragesByCityID(ctx context.Context, cityID string, last int, fn func(*HourlyAverage) error) error
+	GetDailyAveragesByCityID(ctx context.Context, cityID string) ([]map[string]interface{}, error)
+	RebuildHourlyRollups(ctx context.Context, cityID string) (int64, error)
+	EnsureWeatherPartitions(ctx context.Context, from, to time.Time) (int, error)
+	GetWeatherPartitions(ctx context.Context) ([]*WeatherPartition, error)
+	GetWeatherPartitionCityIDs(ctx context.Context, partition *WeatherPartition) ([]string, error)
+	DropWeatherPartition(ctx context.Context, partition *WeatherPartition) error
 
 	// City operations
-	CreateCity(city *City) error
-	GetCityByID(id string) (*City, error)
-	GetCities() ([]*City, error)
-	UpdateCity(city *City) error
-	DeleteCity(id string) error
+	CreateCity(ctx context.Context, city *City) error
+	GetCityByID(ctx context.Context, id string) (*City, error)
+	GetExistingCityIDs(ctx context.Context, ids []string) (map[string]bool, error)
+	GetCities(ctx context.Context) ([]*City, error)
+	UpdateCity(ctx context.Context, city *City) error
+	DeleteCity(ctx context.Context, id, mode, targetID string) (*CityDeletion, error)
+	RestoreCity(ctx context.Context, id string) error
+	PurgeDeletedCities(ctx context.Context, cutoff time.Time) (int64, error)
 
 	// Prediction operations
-	CreatePrediction(prediction *Prediction) error
-	GetPredictionByID(id string) (*Prediction, error)
-	GetPredictionsByCityID(cityID string) ([]*Prediction, error)
+	CreatePrediction(ctx context.Context, prediction *Prediction) error
+	CreatePredictions(ctx context.Context, predictions []*Prediction) ([]*Prediction, error)
+	GetPredictionByID(ctx context.Context, id string) (*Prediction, error)
+	GetPredictionsByCityID(ctx context.Context, cityID string, q PredictionQuery) ([]*Prediction, error)
+	StreamPredictionsByCityID(ctx context.Context, cityID string, q PredictionQuery, fn func(*Prediction) error) error
+	UpdatePrediction(ctx context.Context, prediction *Prediction) error
+	UpsertPrediction(ctx context.Context, prediction *Prediction) (bool, error)
+	DeletePrediction(ctx context.Context, id string) error
+	DeletePredictionsBefore(ctx context.Context, cutoff time.Time, cityID string) (int64, error)
+	PurgeDeletedPredictions(ctx context.Context, cutoff time.Time) (int64, error)
+
+	// Forecast score operations
+	EvaluatePredictions(ctx context.Context, cityID string, from, to time.Time) ([]*ForecastScore, error)
+	CreateForecastScores(ctx context.Context, scores []*ForecastScore) error
+	GetForecastScoresByCityID(ctx context.Context, cityID string) ([]*ForecastScore, error)
+
+	// Retention operations
+	GetRetentionPolicies(ctx context.Context) ([]*RetentionPolicy, error)
+	GetRetentionPolicyByCityID(ctx context.Context, cityID string) (*RetentionPolicy, error)
+	UpsertRetentionPolicy(ctx context.Context, policy *RetentionPolicy) error
+	DeleteRetentionPolicy(ctx context.Context, cityID string) error
+	PruneWeather(ctx context.Context, cityID string, cutoff time.Time) (int64, error)
+	PruneHourlyRollups(ctx context.Context, cityID string, cutoff time.Time) (int64, error)
+
+	// Idempotency key operations
+	ClaimIdempotencyKey(ctx context.Context, key *IdempotencyKey, replace bool) (bool, *IdempotencyKey, error)
+	CompleteIdempotencyKey(ctx context.Context, key *IdempotencyKey, weatherID string) error
+	ReleaseIdempotencyKey(ctx context.Context, key *IdempotencyKey) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error)
+
+	// Device operations
+	CreateDevice(ctx context.Context, device *Device) error
+	GetDevices(ctx context.Context) ([]*Device, error)
+	GetDeviceByID(ctx context.Context, id string) (*Device, error)
+	UpdateDeviceSecret(ctx context.Context, device *Device) error
+	DeleteDevice(ctx context.Context, id string) error
+	UseDeviceNonce(ctx context.Context, deviceID, nonce string, expiresAt time.Time) (bool, error)
+	DeleteExpiredDeviceNonces(ctx context.Context, now time.Time) (int64, error)
+
+	// API token operations
+	CreateAPIToken(ctx context.Context, token *APIToken) error
+	GetAPITokens(ctx context.Context) ([]*APIToken, error)
+	GetAPITokenByID(ctx context.Context, id string) (*APIToken, error)
+	GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error)
+	DeleteAPIToken(ctx context.Context, id string) error
+
+	// Audit operations
+	GetAuditEntries(ctx context.Context, q AuditQuery) ([]*AuditEntry, error)
+
+	// Station operations
+	GetStationsLastSeen(ctx context.Context) ([]*StationStatus, error)
 }
 
 type PostgresStore struct {
-	db *sql.DB
+	db           *tracedDB
+	queryTimeout time.Duration
+}
+
+// Close closes the database connections once in-flight queries are done.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// withTimeout bounds a single query by the configured query timeout on top
+// of the deadline of ctx. Bulk operations and streams are only bound by ctx.
+func (s *PostgresStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.queryTimeout)
 }
 
-func (s *PostgresStore) Init() error {
+func (s *PostgresStore) Init(ctx context.Context) error {
 	// First create the cities table since weather table has a foreign key to it
-	err := s.CreateCityTable()
+	err := s.CreateCityTable(ctx)
 	if err != nil {
 		return err
 	}
 
 	// Then create the weather table which references cities
-	err = s.CreateWeatherTable()
+	err = s.CreateWeatherTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Then create the rollup and retention tables which aggregate weather
+	err = s.CreateRetentionTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Then keep the hourly rollups in sync with the weather table
+	err = s.CreateHourlyRollupTriggers(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Then create the idempotency keys of the readings
+	err = s.CreateIdempotencyKeyTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Then create the devices signing their requests
+	err = s.CreateDeviceTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Then create the API tokens granting roles
+	err = s.CreateAPITokenTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Then create the predictions table
+	err = s.CreatePredictionTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Then create the forecast scores table which references cities
+	err = s.CreateForecastScoreTable(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Finally create the predictions table
-	err = s.CreatePredictionTable()
+	// Finally record the changes of the tables created above
+	err = s.CreateAuditLog(ctx)
 	if err != nil {
 		return err
 	}
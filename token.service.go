@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (server *APIServer) handleCreateAPIToken(w http.ResponseWriter, r *http.Request) error {
+	req := new(CreateAPITokenRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+
+	token, err := NewAPIToken(req.Name, req.Role)
+	if err != nil {
+		return err
+	}
+
+	err = server.store.CreateAPIToken(r.Context(), token)
+	if err != nil {
+		return err
+	}
+
+	// The token is only ever returned here
+	return WriteJSON(w, http.StatusOK, token)
+}
+
+func (server *APIServer) handleGetAPITokens(w http.ResponseWriter, r *http.Request) error {
+	tokens, err := server.store.GetAPITokens(r.Context())
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, tokens)
+}
+
+func (server *APIServer) handleGetAPITokenByID(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	token, err := server.store.GetAPITokenByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, token)
+}
+
+func (server *APIServer) handleDeleteAPIToken(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	err = server.store.DeleteAPIToken(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": id})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+func (s *PostgresStore) CreateAPITokenTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS api_tokens (
+            id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+            name TEXT NOT NULL,
+            role TEXT NOT NULL,
+            token_hash TEXT NOT NULL UNIQUE,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+	return err
+}
+
+func (s *PostgresStore) CreateAPIToken(ctx context.Context, token *APIToken) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO api_tokens (name, role, token_hash) 
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		return tx.QueryRowContext(ctx, query, token.Name, token.Role, token.TokenHash).Scan(&token.ID, &token.CreatedAt)
+	})
+}
+
+func (s *PostgresStore) GetAPITokens(ctx context.Context) ([]*APIToken, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, role, token_hash, created_at 
+		FROM api_tokens 
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var tokens []*APIToken
+	for rows.Next() {
+		token, err := scanIntoAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (s *PostgresStore) GetAPITokenByID(ctx context.Context, id string) (*APIToken, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, role, token_hash, created_at 
+		FROM api_tokens 
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		return scanIntoAPIToken(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("api token [%s] not found", id)
+}
+
+// GetAPITokenByHash returns the token with the given hash. The error of an
+// unknown token wraps sql.ErrNoRows.
+func (s *PostgresStore) GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, role, token_hash, created_at 
+		FROM api_tokens 
+		WHERE token_hash = $1
+	`, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		return scanIntoAPIToken(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("api token not found: %w", sql.ErrNoRows)
+}
+
+func scanIntoAPIToken(rows *tracedRows) (*APIToken, error) {
+	token := new(APIToken)
+	err := rows.Scan(
+		&token.ID,
+		&token.Name,
+		&token.Role,
+		&token.TokenHash,
+		&token.CreatedAt,
+	)
+
+	return token, err
+}
+
+func (s *PostgresStore) DeleteAPIToken(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		DELETE FROM api_tokens 
+		WHERE id = $1
+	`
+
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		_, err := tx.ExecContext(ctx, query, id)
+		return err
+	})
+}
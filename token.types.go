@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Roles granted to API tokens.
+const (
+	RoleReader  = "reader"
+	RoleStation = "station"
+	RoleEditor  = "editor"
+	RoleAdmin   = "admin"
+)
+
+// Permissions required by the routes.
+const (
+	PermissionRead   = "read"
+	PermissionIngest = "ingest"
+	PermissionEdit   = "edit"
+	PermissionAdmin  = "admin"
+)
+
+// rolePermissions lists what each role may do: readers only read, stations
+// only send readings, editors manage forecasts and imports, and admins may
+// also edit and delete cities, readings, devices and tokens.
+var rolePermissions = map[string][]string{
+	RoleReader:  {PermissionRead},
+	RoleStation: {PermissionIngest},
+	RoleEditor:  {PermissionRead, PermissionIngest, PermissionEdit},
+	RoleAdmin:   {PermissionRead, PermissionIngest, PermissionEdit, PermissionAdmin},
+}
+
+// apiTokenBytes is the size of the generated API tokens.
+const apiTokenBytes = 32
+
+// minAdminTokenLength keeps the configured admin token from being guessed.
+const minAdminTokenLength = 32
+
+// APIToken grants its role to the requests carrying it as a bearer token.
+// Only its hash is stored, the token itself is returned once on creation.
+type APIToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Token     string    `json:"token,omitempty"`
+	TokenHash string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateAPITokenRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// NewAPIToken generates a token granting role.
+func NewAPIToken(name, role string) (*APIToken, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if _, ok := rolePermissions[role]; !ok {
+		return nil, fmt.Errorf("role must be one of %s, %s, %s, %s", RoleReader, RoleStation, RoleEditor, RoleAdmin)
+	}
+
+	secret := make([]byte, apiTokenBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(secret)
+
+	return &APIToken{
+		Name:      name,
+		Role:      role,
+		Token:     token,
+		TokenHash: hashAPIToken(token),
+	}, nil
+}
+
+// hashAPIToken returns the hash tokens are stored and looked up by.
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// RoleCan reports whether role grants permission.
+func RoleCan(role, permission string) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
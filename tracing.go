@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// tracerName names the instrumentation of this module in the traces.
+const tracerName = "github.com/AndresCampuzano/weather-api-raspberry-pi-pico-2-w"
+
+// maxQueryTextLength bounds the SQL recorded on query spans.
+const maxQueryTextLength = 2048
+
+// SetupTracing installs the global tracer provider exporting to the
+// configured exporter, and the W3C trace context propagator. It returns the
+// function flushing and stopping the exporter on shutdown.
+func SetupTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(cfg.ServiceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// traceRequests is a middleware which continues the trace of the incoming
+// request headers, or starts one, with a span around the route handler.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := routeTemplate(r)
+		ctx, span := otel.Tracer(tracerName).Start(
+			ctx,
+			r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		// Deferred so aborted requests are recorded too
+		defer func() {
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		}()
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+	})
+}
+
+// tracedDB wraps the database connections so that every query is recorded
+// as a span named after the store method running it. The span of a query
+// returning rows lasts until they are closed, so that it covers reading
+// them.
+type tracedDB struct {
+	*sql.DB
+}
+
+func (db *tracedDB) QueryContext(ctx context.Context, query string, args ...any) (*tracedRows, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	return traceRows(span, rows, err)
+}
+
+func (db *tracedDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := startQuerySpan(ctx, query)
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	endQuerySpan(span, row.Err())
+	return row
+}
+
+func (db *tracedDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	result, err := db.DB.ExecContext(ctx, query, args...)
+	endQuerySpan(span, err)
+	return result, err
+}
+
+func (db *tracedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*tracedTx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedTx{tx}, nil
+}
+
+// tracedTx records the queries of a transaction as spans, like tracedDB.
+type tracedTx struct {
+	*sql.Tx
+}
+
+func (tx *tracedTx) QueryContext(ctx context.Context, query string, args ...any) (*tracedRows, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	return traceRows(span, rows, err)
+}
+
+func (tx *tracedTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := startQuerySpan(ctx, query)
+	row := tx.Tx.QueryRowContext(ctx, query, args...)
+	endQuerySpan(span, row.Err())
+	return row
+}
+
+func (tx *tracedTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	result, err := tx.Tx.ExecContext(ctx, query, args...)
+	endQuerySpan(span, err)
+	return result, err
+}
+
+func (tx *tracedTx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	ctx, span := startQuerySpan(ctx, query)
+	stmt, err := tx.Tx.PrepareContext(ctx, query)
+	endQuerySpan(span, err)
+	return stmt, err
+}
+
+// tracedRows ends the span of their query once closed.
+type tracedRows struct {
+	*sql.Rows
+	span   trace.Span
+	closed bool
+}
+
+func traceRows(span trace.Span, rows *sql.Rows, err error) (*tracedRows, error) {
+	if err != nil {
+		endQuerySpan(span, err)
+		return nil, err
+	}
+	return &tracedRows{Rows: rows, span: span}, nil
+}
+
+// Close closes the rows and ends the span of their query, recording the
+// error met while reading them, if any.
+func (rows *tracedRows) Close() error {
+	err := rows.Rows.Close()
+	if !rows.closed {
+		rows.closed = true
+		spanErr := rows.Rows.Err()
+		if spanErr == nil {
+			spanErr = err
+		}
+		endQuerySpan(rows.span, spanErr)
+	}
+	return err
+}
+
+// startQuerySpan starts the span of a query, named after the function
+// which called the tracedDB or tracedTx method.
+func startQuerySpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	function := "query"
+	if pc, _, _, ok := runtime.Caller(2); ok {
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			// Drop the package path: main.(*PostgresStore).GetCityByID
+			// becomes PostgresStore.GetCityByID
+			name := fn.Name()
+			name = name[strings.LastIndex(name, "/")+1:]
+			_, name, _ = strings.Cut(name, ".")
+			function = strings.NewReplacer("(*", "", ")", "").Replace(name)
+		}
+	}
+
+	text := strings.Join(strings.Fields(query), " ")
+	operation, _, _ := strings.Cut(text, " ")
+	if len(text) > maxQueryTextLength {
+		text = text[:maxQueryTextLength]
+	}
+
+	return otel.Tracer(tracerName).Start(
+		ctx,
+		function,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationName(strings.ToUpper(operation)),
+			semconv.DBQueryText(text),
+			semconv.CodeFunction(function),
+		),
+	)
+}
+
+func endQuerySpan(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"log"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -25,24 +32,88 @@ type apiFunc func(http.ResponseWriter, *http.Request) error
 
 // apiError represents an error response in JSON format.
 type apiError struct {
-	Error string `json:"error"`
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // makeHTTPHandlerFunc creates an HTTP handler function from the given apiFunc.
 // It calls the provided function f to handle HTTP requests, and if an error occurs, it writes
-// the error response as JSON with status code http.StatusBadRequest.
+// the error response as JSON with the status code given by errorStatus and logs it.
 func makeHTTPHandlerFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			err := WriteJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+			ctx := r.Context()
+			status := errorStatus(err)
+
+			level := slog.LevelWarn
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			slog.Log(ctx, level, "request failed", "status", status, "error", err)
+			trace.SpanFromContext(ctx).RecordError(err)
+
+			// The client may be gone already, which must not stop the server
+			err := WriteJSON(w, status, apiError{Error: err.Error(), RequestID: RequestIDFromContext(ctx)})
 			if err != nil {
-				log.Fatal(err)
+				slog.WarnContext(ctx, "writing error response", "error", err)
 				return
 			}
 		}
 	}
 }
 
+// writeAPIError answers r with an error of the given status, for the
+// middlewares running before the handlers.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	ctx := r.Context()
+	err := WriteJSON(w, status, apiError{Error: message, RequestID: RequestIDFromContext(ctx)})
+	if err != nil {
+		slog.WarnContext(ctx, "writing error response", "error", err)
+	}
+}
+
+// errorStatus maps a handler error to its HTTP status code. Queries that ran
+// out of time are reported with http.StatusGatewayTimeout, a database that
+// cannot be reached or a cancelled request with http.StatusServiceUnavailable
+// and anything else with http.StatusBadRequest.
+func errorStatus(err error) int {
+	var pqErr *pq.Error
+	isPqErr := errors.As(err, &pqErr)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	// query_canceled is also raised by the server side statement_timeout
+	case isPqErr && pqErr.Code == "57014":
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, sql.ErrConnDone), errors.Is(err, driver.ErrBadConn):
+		return http.StatusServiceUnavailable
+	// Connection exceptions, insufficient resources and operator intervention
+	case isPqErr && (pqErr.Code.Class() == "08" || pqErr.Code.Class() == "53" || pqErr.Code.Class() == "57"):
+		return http.StatusServiceUnavailable
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadRequest
+}
+
+// clearDeadlines lifts the server read and write timeouts of a request
+// which streams large bodies, leaving it bound by the request context only.
+func clearDeadlines(w http.ResponseWriter) error {
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
 // getID extracts the ID parameter from the URL path of the HTTP request r.
 // It returns the extracted ID and an error if the ID is invalid or not found in the request.
 func getID(r *http.Request) (string, error) {
@@ -55,6 +126,23 @@ func getID(r *http.Request) (string, error) {
 	return id, nil
 }
 
+// getIdempotencyKey returns the idempotency key of a request creating a
+// reading, from its Idempotency-Key header or else its sequence number, if
+// any. Keys from sequence numbers may be replaced, as devices start their
+// sequence over when they restart.
+func getIdempotencyKey(r *http.Request, req *CreateWeatherRequest) (string, bool, error) {
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			return "", false, fmt.Errorf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+		}
+		return key, false, nil
+	}
+	if req.Sequence != nil {
+		return "seq:" + strconv.FormatInt(*req.Sequence, 10), true, nil
+	}
+	return "", false, nil
+}
+
 // FilterLastNAverages filters the last N averages from the provided averages slice.
 func FilterLastNAverages(averages []map[string]interface{}, getLast string) ([]map[string]interface{}, error) {
 	lastN, err := strconv.Atoi(getLast)
@@ -83,3 +171,18 @@ func FilterWeathersByLastHours(weathers []*Weather, getLast string) ([]*Weather,
 	}
 	return filteredWeathers, nil
 }
+
+// getTimeParam parses the RFC 3339 query parameter key of the HTTP request r as UTC time,
+// returning def when the parameter is missing.
+func getTimeParam(r *http.Request, key string, def time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return def, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", key)
+	}
+	return t.UTC(), nil
+}
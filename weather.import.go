@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields of a reading that can be mapped to CSV columns.
+var weatherImportFields = []string{"temperature", "humidity", "timestamp", "city", "city_id"}
+
+// maxReportedRejections caps the rejected rows listed in an import report,
+// the total is always counted.
+const maxReportedRejections = 1000
+
+// WeatherImportOptions configures how a CSV file of historical readings is
+// read. Mapping maps a reading field (temperature, humidity, timestamp,
+// city or city_id) to the CSV column holding it; unmapped fields are read
+// from the column of the same name. TimeFormat is a Go time layout, or
+// "rfc3339" or "unix".
+type WeatherImportOptions struct {
+	Mapping    map[string]string
+	TimeFormat string
+	Location   *time.Location
+	CityID     string
+	CityName   string
+	DryRun     bool
+}
+
+// WeatherImportError reports why a CSV line was rejected.
+type WeatherImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// WeatherImportResult reports the outcome of an import. Only the first
+// maxReportedRejections rejected lines are listed.
+type WeatherImportResult struct {
+	DryRun        bool                 `json:"dry_run"`
+	Total         int                  `json:"total"`
+	Imported      int64                `json:"imported"`
+	RejectedCount int                  `json:"rejected_count"`
+	Rejected      []WeatherImportError `json:"rejected"`
+}
+
+// parseWeatherMapping parses a mapping such as "temperature=temp_c,city=station".
+func parseWeatherMapping(value string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if value == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		field, column, ok := strings.Cut(pair, "=")
+		field = strings.TrimSpace(field)
+		if !ok || field == "" || strings.TrimSpace(column) == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected field=column", pair)
+		}
+		if !isWeatherImportField(field) {
+			return nil, fmt.Errorf("unknown mapping field %q", field)
+		}
+		mapping[field] = strings.TrimSpace(column)
+	}
+	return mapping, nil
+}
+
+func isWeatherImportField(field string) bool {
+	for _, f := range weatherImportFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportWeatherCSV reads historical readings from a CSV file and bulk loads
+// the valid rows, keeping their original timestamps. Rejected rows are
+// reported by line and skipped. With opts.DryRun nothing is stored.
+func ImportWeatherCSV(ctx context.Context, store Storage, r io.Reader, opts WeatherImportOptions) (*WeatherImportResult, error) {
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if opts.TimeFormat == "" {
+		opts.TimeFormat = "rfc3339"
+	}
+
+	resolver, err := newCityResolver(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for _, field := range weatherImportFields {
+		name := field
+		if column, ok := opts.Mapping[field]; ok {
+			name = column
+		}
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				columns[field] = i
+				break
+			}
+		}
+	}
+	for _, required := range []string{"temperature", "humidity", "timestamp"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("csv has no column for %s", required)
+		}
+	}
+	_, hasCity := columns["city"]
+	_, hasCityID := columns["city_id"]
+	if !hasCity && !hasCityID && opts.CityID == "" && opts.CityName == "" {
+		return nil, fmt.Errorf("csv has no column for city or city_id and no city was given")
+	}
+
+	result := &WeatherImportResult{
+		DryRun:   opts.DryRun,
+		Rejected: []WeatherImportError{},
+	}
+	reject := func(line int, err error) {
+		result.RejectedCount++
+		if len(result.Rejected) < maxReportedRejections {
+			result.Rejected = append(result.Rejected, WeatherImportError{Line: line, Error: err.Error()})
+		}
+	}
+
+	// Errors reading the file, unlike bad rows, end the import so that the
+	// rows read so far aren't stored
+	weathers := func(yield func(*Weather, error) bool) {
+		for {
+			record, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				var parseErr *csv.ParseError
+				if !errors.As(err, &parseErr) {
+					yield(nil, err)
+					return
+				}
+				result.Total++
+				reject(parseErr.Line, parseErr.Err)
+				continue
+			}
+			result.Total++
+			line, _ := reader.FieldPos(0)
+
+			weather, err := parseWeatherRecord(record, columns, resolver, opts)
+			if err != nil {
+				reject(line, err)
+				continue
+			}
+
+			if !yield(weather, nil) {
+				return
+			}
+		}
+	}
+
+	if opts.DryRun {
+		for _, err := range weathers {
+			if err != nil {
+				return nil, err
+			}
+			result.Imported++
+		}
+	} else {
+		result.Imported, err = store.CopyWeathers(ctx, weathers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func parseWeatherRecord(record []string, columns map[string]int, resolver *cityResolver, opts WeatherImportOptions) (*Weather, error) {
+	get := func(field string) string {
+		i, ok := columns[field]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	temperature, err := strconv.ParseFloat(get("temperature"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid temperature %q", get("temperature"))
+	}
+	humidity, err := strconv.ParseFloat(get("humidity"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid humidity %q", get("humidity"))
+	}
+	createdAt, err := parseImportTime(get("timestamp"), opts.TimeFormat, opts.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	cityID, err := resolver.resolve(
+		firstNonEmpty(opts.CityID, get("city_id")),
+		firstNonEmpty(opts.CityName, get("city")),
+		nil,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	weather, err := NewWeather(temperature, humidity, cityID)
+	if err != nil {
+		return nil, err
+	}
+	weather.CreatedAt = createdAt
+
+	return weather, nil
+}
+
+// parseImportTime parses value with the given layout in location and
+// returns it as UTC.
+func parseImportTime(value, layout string, location *time.Location) (time.Time, error) {
+	switch layout {
+	case "unix":
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid unix timestamp %q", value)
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	case "rfc3339":
+		layout = time.RFC3339
+	}
+
+	t, err := time.ParseInLocation(layout, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+	}
+	return t.UTC(), nil
+}
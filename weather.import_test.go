@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"strings"
+	"testing"
+)
+
+// fakeStore is a Storage holding cities in memory. Methods not overridden
+// panic through the nil embedded Storage.
+type fakeStore struct {
+	Storage
+	cities []*City
+
+	copied    []*Weather
+	committed bool
+}
+
+func (s *fakeStore) GetCities(ctx context.Context) ([]*City, error) {
+	return s.cities, nil
+}
+
+func (s *fakeStore) GetExistingCityIDs(ctx context.Context, ids []string) (map[string]bool, error) {
+	existing := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		for _, city := range s.cities {
+			if city.ID == id {
+				existing[id] = true
+			}
+		}
+	}
+	return existing, nil
+}
+
+// CopyWeathers keeps the readings only once every one was read, like the
+// transaction of PostgresStore.CopyWeathers.
+func (s *fakeStore) CopyWeathers(ctx context.Context, weathers iter.Seq2[*Weather, error]) (int64, error) {
+	var copied []*Weather
+	for weather, err := range weathers {
+		if err != nil {
+			return 0, err
+		}
+		copied = append(copied, weather)
+	}
+	s.copied = copied
+	s.committed = true
+	return int64(len(copied)), nil
+}
+
+// failingReader fails once the data it holds is read.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+const testCityID = "6f1c2a52-8d3e-4b7a-9c11-0d2e4f6a8b10"
+
+func TestImportWeatherCSV(t *testing.T) {
+	store := &fakeStore{cities: []*City{{ID: testCityID, Name: "Medellín"}}}
+	csv := "timestamp,temperature,humidity,city\n" +
+		"2024-01-01T00:00:00Z,21.5,60,Medellín\n" +
+		"2024-01-01T01:00:00Z,not a number,61,Medellín\n" +
+		"2024-01-01T02:00:00Z,20.5,62,Bogotá\n" +
+		"2024-01-01T03:00:00Z,20,63,medellín\n"
+
+	result, err := ImportWeatherCSV(context.Background(), store, strings.NewReader(csv), WeatherImportOptions{})
+	if err != nil {
+		t.Fatalf("ImportWeatherCSV() error = %v", err)
+	}
+
+	if result.Total != 4 || result.Imported != 2 || result.RejectedCount != 2 {
+		t.Errorf("total, imported, rejected = %d, %d, %d, want 4, 2, 2", result.Total, result.Imported, result.RejectedCount)
+	}
+	for i, line := range []int{3, 4} {
+		if result.Rejected[i].Line != line {
+			t.Errorf("rejected[%d].Line = %d, want %d", i, result.Rejected[i].Line, line)
+		}
+	}
+	if len(store.copied) != 2 || store.copied[1].CityID != testCityID || store.copied[1].CreatedAt.Hour() != 3 {
+		t.Errorf("copied = %+v", store.copied)
+	}
+}
+
+func TestImportWeatherCSVReadError(t *testing.T) {
+	store := &fakeStore{cities: []*City{{ID: testCityID, Name: "Medellín"}}}
+	readErr := errors.New("connection reset by peer")
+	r := &failingReader{
+		r: strings.NewReader("timestamp,temperature,humidity,city\n" +
+			"2024-01-01T00:00:00Z,21.5,60,Medellín\n" +
+			"2024-01-01T01:00:00Z,21,61,Medellín\n" +
+			"2024-01-01T02:00:00Z,20.5,"),
+		err: readErr,
+	}
+
+	_, err := ImportWeatherCSV(context.Background(), store, r, WeatherImportOptions{})
+	if !errors.Is(err, readErr) {
+		t.Fatalf("ImportWeatherCSV() error = %v, want %v", err, readErr)
+	}
+	if store.committed {
+		t.Errorf("%d readings were stored from a partial upload", len(store.copied))
+	}
+
+	// A dry run reports the error too
+	r.r = strings.NewReader("timestamp,temperature,humidity,city\n2024-01-01T00:00:00Z,21.5,60,Medellín\n")
+	_, err = ImportWeatherCSV(context.Background(), store, r, WeatherImportOptions{DryRun: true})
+	if !errors.Is(err, readErr) {
+		t.Errorf("dry run error = %v, want %v", err, readErr)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// weatherPartitionsAhead is how many months of weather partitions are
+// created ahead of the current one.
+const weatherPartitionsAhead = 3
+
+// weatherPartitionLayout names the monthly weather partitions.
+const weatherPartitionLayout = "weather_p2006_01"
+
+// createPartitionedWeatherTable creates the weather table partitioned by
+// month of created_at, with a default partition catching readings outside
+// of the created months, such as historical imports. A weather table
+// created before partitioning is moved into partitions in one transaction.
+func (s *PostgresStore) createPartitionedWeatherTable(ctx context.Context) error {
+	var kind sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+		SELECT relkind::text FROM pg_class WHERE oid = to_regclass('weather')
+	`).Scan(&kind)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// Already partitioned
+	if kind.String == "p" {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	legacy := kind.String == "r"
+	if legacy {
+		// The primary key index name is needed by the new table
+		_, err = tx.ExecContext(ctx, `
+			ALTER TABLE weather RENAME TO weather_legacy;
+			ALTER TABLE weather_legacy DROP CONSTRAINT weather_pkey;
+			DROP INDEX IF EXISTS weather_city_id_created_at_idx;
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The partition key has to be part of the primary key
+	_, err = tx.ExecContext(ctx, `
+        CREATE TABLE weather (
+            id UUID DEFAULT uuid_generate_v4(),
+            temperature FLOAT NOT NULL,
+            humidity FLOAT NOT NULL,
+            city_id UUID NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP NULL,
+            PRIMARY KEY (id, created_at),
+            FOREIGN KEY (city_id) REFERENCES cities(id)
+        ) PARTITION BY RANGE (created_at);
+
+        CREATE TABLE weather_default PARTITION OF weather DEFAULT;
+    `)
+	if err != nil {
+		return err
+	}
+
+	if legacy {
+		months, err := queryMonths(ctx, tx, `
+			SELECT DISTINCT date_trunc('month', created_at) FROM weather_legacy WHERE created_at IS NOT NULL
+		`)
+		if err != nil {
+			return err
+		}
+		for _, month := range months {
+			if _, err := createWeatherPartition(ctx, tx, month); err != nil {
+				return err
+			}
+		}
+
+		// The new table has no triggers yet, so timestamps are kept as is
+		// and the rollups, rebuilt once the triggers exist, are untouched
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO weather (id, temperature, humidity, city_id, created_at, updated_at)
+			SELECT id, temperature, humidity, city_id, COALESCE(created_at, updated_at, NOW()), updated_at
+			FROM weather_legacy;
+
+			DROP TABLE weather_legacy;
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// EnsureWeatherPartitions creates the monthly weather partitions from the
+// month of from through the month of to, and the partitions of the months
+// with readings in the default partition, moving those readings into them.
+// It returns the number of partitions created.
+func (s *PostgresStore) EnsureWeatherPartitions(ctx context.Context, from, to time.Time) (int, error) {
+	months, err := queryMonths(ctx, s.db, `
+		SELECT DISTINCT date_trunc('month', created_at) FROM weather_default
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	from = startOfMonth(from)
+	for month := from; !month.After(to); month = month.AddDate(0, 1, 0) {
+		months = append(months, month)
+	}
+
+	var created int
+	for _, month := range months {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return created, err
+		}
+
+		ok, err := createWeatherPartition(ctx, tx, month)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return created, err
+		}
+		if ok {
+			created++
+		}
+	}
+
+	return created, nil
+}
+
+// GetWeatherPartitions returns the monthly weather partitions, oldest first.
+// The default partition is not included.
+func (s *PostgresStore) GetWeatherPartitions(ctx context.Context) ([]*WeatherPartition, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT c.relname 
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'weather'::regclass AND c.relname <> 'weather_default'
+		ORDER BY c.relname
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var partitions []*WeatherPartition
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		month, err := time.Parse(weatherPartitionLayout, name)
+		if err != nil {
+			// Not one of ours
+			continue
+		}
+		partitions = append(partitions, &WeatherPartition{
+			Name: name,
+			From: month,
+			To:   month.AddDate(0, 1, 0),
+		})
+	}
+
+	return partitions, rows.Err()
+}
+
+// GetWeatherPartitionCityIDs returns the cities with readings in the
+// partition.
+func (s *PostgresStore) GetWeatherPartitionCityIDs(ctx context.Context, partition *WeatherPartition) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT city_id FROM weather 
+		WHERE created_at >= $1 AND created_at < $2
+	`, partition.From, partition.To)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var cityIDs []string
+	for rows.Next() {
+		var cityID string
+		if err := rows.Scan(&cityID); err != nil {
+			return nil, err
+		}
+		cityIDs = append(cityIDs, cityID)
+	}
+
+	return cityIDs, rows.Err()
+}
+
+// DropWeatherPartition drops a monthly weather partition with all its
+// readings at once. Dropping doesn't fire the rollup triggers, so the
+// hourly aggregates of the readings are kept.
+func (s *PostgresStore) DropWeatherPartition(ctx context.Context, partition *WeatherPartition) error {
+	if partition.Name != weatherPartitionName(partition.From) {
+		return fmt.Errorf("weather partition [%s] not found", partition.Name)
+	}
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", partition.Name))
+	return err
+}
+
+// createWeatherPartition creates the partition of month unless it exists,
+// moving the readings of that month out of the default partition first.
+// It reports whether the partition was created.
+func createWeatherPartition(ctx context.Context, tx *tracedTx, month time.Time) (bool, error) {
+	month = startOfMonth(month)
+	name := weatherPartitionName(month)
+
+	var exists bool
+	err := tx.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	// DDL doesn't take parameters; the name and bounds are generated
+	from := month.Format(time.DateTime)
+	to := month.AddDate(0, 1, 0).Format(time.DateTime)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE %[1]s (LIKE weather INCLUDING DEFAULTS INCLUDING CONSTRAINTS);
+
+		-- Moving readings between partitions isn't a change to audit
+		SET LOCAL weather.skip_audit = 'on';
+
+		WITH moved AS (
+			DELETE FROM weather_default
+			WHERE created_at >= '%[2]s' AND created_at < '%[3]s'
+			RETURNING *
+		)
+		INSERT INTO %[1]s SELECT * FROM moved;
+
+		ALTER TABLE weather ATTACH PARTITION %[1]s FOR VALUES FROM ('%[2]s') TO ('%[3]s');
+	`, name, from, to))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// queryMonths runs a query selecting a single timestamp column.
+func queryMonths(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*tracedRows, error)
+}, query string) ([]time.Time, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var months []time.Time
+	for rows.Next() {
+		var month time.Time
+		if err := rows.Scan(&month); err != nil {
+			return nil, err
+		}
+		months = append(months, month)
+	}
+
+	return months, rows.Err()
+}
+
+func weatherPartitionName(month time.Time) string {
+	return startOfMonth(month).Format(weatherPartitionLayout)
+}
+
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
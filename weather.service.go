@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"log/slog"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func (server *APIServer) handleCreateWeather(w http.ResponseWriter, r *http.Request) error {
@@ -13,7 +17,7 @@ func (server *APIServer) handleCreateWeather(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Verify the city exists first
-	_, err := server.store.GetCityByID(req.CityID)
+	_, err := server.store.GetCityByID(r.Context(), req.CityID)
 	if err != nil {
 		return err
 	}
@@ -27,27 +31,99 @@ func (server *APIServer) handleCreateWeather(w http.ResponseWriter, r *http.Requ
 		return err
 	}
 
-	err = server.store.CreateWeather(weather)
+	// Readings are throttled and deduplicated per authenticated device, and
+	// the anonymous stations are told apart by their address and city
+	device := requestDevice(r)
+	if _, ok := PrincipalFromContext(r.Context()); !ok {
+		device += "|city:" + req.CityID
+	}
+
+	// Retries of a request under the same key get the reading stored by
+	// the first one
+	name, replace, err := getIdempotencyKey(r, req)
 	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	var key *IdempotencyKey
+	if name != "" {
+		key, err = NewIdempotencyKey(device, name, req, server.config.IdempotencyKeyTTL.Duration)
+		if err != nil {
+			return err
+		}
+
+		claimed, existing, err := server.store.ClaimIdempotencyKey(r.Context(), key, replace)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return server.replayIdempotentWeather(w, r, key, existing)
+		}
+	}
+
+	// Readings sent too soon after the last one are dropped or merged
+	id, status, err := server.throttle.Save(r.Context(), device, weather, key)
+	if err != nil {
+		if key != nil {
+			// Let the client retry right away rather than after the key
+			// times out
+			if err := server.store.ReleaseIdempotencyKey(context.WithoutCancel(r.Context()), key); err != nil {
+				slog.WarnContext(r.Context(), "releasing idempotency key", "error", err)
+			}
+		}
 		return err
 	}
+	if key != nil && status != ReadingStored {
+		// Stored readings complete their key in the same transaction; the
+		// others are recorded even if the client is gone, as its retry must
+		// not merge the reading again
+		if err := server.store.CompleteIdempotencyKey(context.WithoutCancel(r.Context()), key, id); err != nil {
+			return err
+		}
+	}
+	w.Header().Set(readingStatusHeader, status)
+	if status == ReadingDropped {
+		retryAfter := server.throttle.RetryAfter(device)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
 
 	// Recovering weather from DB
-	createdWeather, err := server.store.GetWeatherByID(weather.ID)
+	createdWeather, err := server.store.GetWeatherByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
 
+	server.monitor.Observe(r.Context(), createdWeather, r.Header.Get(deviceIDHeader))
+
 	return WriteJSON(w, http.StatusOK, createdWeather)
 }
 
+// replayIdempotentWeather answers the retry of a request with the reading
+// stored under its idempotency key.
+func (server *APIServer) replayIdempotentWeather(w http.ResponseWriter, r *http.Request, key, existing *IdempotencyKey) error {
+	if existing.RequestHash != key.RequestHash {
+		return WriteJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "idempotency key already used for another request"})
+	}
+	if existing.WeatherID == nil {
+		w.Header().Set("Retry-After", "1")
+		return WriteJSON(w, http.StatusConflict, map[string]string{"error": "request with this idempotency key in progress"})
+	}
+
+	weather, err := server.store.GetWeatherByID(r.Context(), *existing.WeatherID)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set(idempotentReplayedHeader, "true")
+	return WriteJSON(w, http.StatusOK, weather)
+}
+
 func (server *APIServer) handleGetWeatherByID(w http.ResponseWriter, r *http.Request) error {
 	id, err := getID(r)
 	if err != nil {
 		return err
 	}
 
-	weather, err := server.store.GetWeatherByID(id)
+	weather, err := server.store.GetWeatherByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
@@ -56,6 +132,14 @@ func (server *APIServer) handleGetWeatherByID(w http.ResponseWriter, r *http.Req
 }
 
 func (server *APIServer) handleGetWeathers(w http.ResponseWriter, r *http.Request) error {
+	format, err := getExportFormat(r)
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if format != ExportJSON {
+		return server.handleExportWeathers(w, r, format)
+	}
+
 	cityID := r.URL.Query().Get("city_id")
 	hourlyAverage := r.URL.Query().Get("hourly_average") == "true"
 	getLast := r.URL.Query().Get("get_last")
@@ -67,12 +151,15 @@ func (server *APIServer) handleGetWeathers(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	if hourlyAverage {
+	if r.URL.Query().Get("daily_average") == "true" {
 		if cityID == "" {
-			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "city_id is required for hourly averages"})
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "city_id is required for daily averages"})
 		}
 
-		averages, err := server.store.GetHourlyAveragesByCityID(cityID)
+		averages, err := server.store.GetDailyAveragesByCityID(r.Context(), cityID)
+		if err != nil {
+			return err
+		}
 
 		if getLast != "" {
 			averages, err = FilterLastNAverages(averages, getLast)
@@ -80,20 +167,39 @@ func (server *APIServer) handleGetWeathers(w http.ResponseWriter, r *http.Reques
 				return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 			}
 		}
+
+		return WriteJSON(w, http.StatusOK, averages)
+	}
+
+	if hourlyAverage {
+		if cityID == "" {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "city_id is required for hourly averages"})
+		}
+
+		averages, err := server.store.GetHourlyAveragesByCityID(r.Context(), cityID)
 		if err != nil {
 			return err
 		}
 
+		if getLast != "" {
+			averages, err = FilterLastNAverages(averages, getLast)
+			if err != nil {
+				return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			}
+		}
+
 		return WriteJSON(w, http.StatusOK, averages)
 	}
 
 	var weathers []*Weather
-	var err error
 
 	if cityID != "" {
-		weathers, err = server.store.GetWeathersByCityID(cityID)
+		weathers, err = server.store.GetWeathersByCityID(r.Context(), cityID)
 	} else {
-		weathers, err = server.store.GetWeathers()
+		weathers, err = server.store.GetWeathers(r.Context())
+	}
+	if err != nil {
+		return err
 	}
 
 	if getLast != "" {
@@ -103,10 +209,6 @@ func (server *APIServer) handleGetWeathers(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	if err != nil {
-		return err
-	}
-
 	return WriteJSON(w, http.StatusOK, weathers)
 }
 
@@ -116,7 +218,7 @@ func (server *APIServer) handleUpdateWeather(w http.ResponseWriter, r *http.Requ
 		return err
 	}
 
-	_, err = server.store.GetWeatherByID(id)
+	_, err = server.store.GetWeatherByID(r.Context(), id)
 	if err != nil {
 		return err
 	}
@@ -130,18 +232,18 @@ func (server *APIServer) handleUpdateWeather(w http.ResponseWriter, r *http.Requ
 
 	// Verify the city exists
 	if weather.CityID != "" {
-		_, err = server.store.GetCityByID(weather.CityID)
+		_, err = server.store.GetCityByID(r.Context(), weather.CityID)
 		if err != nil {
 			return err
 		}
 	}
 
-	if err := server.store.UpdateWeather(&weather); err != nil {
+	if err := server.store.UpdateWeather(r.Context(), &weather); err != nil {
 		return err
 	}
 
 	// Recovering data from DB to get the most up-to-date data
-	updatedWeather, err := server.store.GetWeatherByID(weather.ID)
+	updatedWeather, err := server.store.GetWeatherByID(r.Context(), weather.ID)
 	if err != nil {
 		return err
 	}
@@ -155,10 +257,46 @@ func (server *APIServer) handleDeleteWeather(w http.ResponseWriter, r *http.Requ
 		return err
 	}
 
-	err = server.store.DeleteWeather(id)
+	err = server.store.DeleteWeather(r.Context(), id)
 	if err != nil {
 		return err
 	}
 
 	return WriteJSON(w, http.StatusOK, map[string]string{"deleted": id})
 }
+
+func (server *APIServer) handleImportWeathers(w http.ResponseWriter, r *http.Request) error {
+	// Uploads may take longer than the server read timeout allows
+	if err := clearDeadlines(w); err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+
+	mapping, err := parseWeatherMapping(query.Get("mapping"))
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	location := time.UTC
+	if query.Get("timezone") != "" {
+		location, err = time.LoadLocation(query.Get("timezone"))
+		if err != nil {
+			return WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+
+	result, err := ImportWeatherCSV(r.Context(), server.store, r.Body, WeatherImportOptions{
+		Mapping:    mapping,
+		TimeFormat: query.Get("time_format"),
+		Location:   location,
+		CityID:     query.Get("city_id"),
+		CityName:   query.Get("city"),
+		DryRun:     query.Get("dry_run") == "true",
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, result)
+}
@@ -1,23 +1,35 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
-	"log"
+	"github.com/lib/pq"
+	"iter"
+	"log/slog"
+	"time"
 )
 
-func (s *PostgresStore) CreateWeatherTable() error {
-	// Create the table if it doesn't exist
-	_, err := s.db.Exec(`
-        CREATE TABLE IF NOT EXISTS weather (
-            id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
-            temperature FLOAT NOT NULL,
-            humidity FLOAT NOT NULL,
-            city_id UUID NOT NULL,
-            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-            updated_at TIMESTAMP NULL,
-            FOREIGN KEY (city_id) REFERENCES cities(id)
-        )
+// weatherColumns lists the weather columns in the order expected by scanIntoWeather.
+const weatherColumns = "id, temperature, humidity, city_id, created_at, updated_at, deleted_at"
+
+func (s *PostgresStore) CreateWeatherTable(ctx context.Context) error {
+	// Create the table partitioned by month if it doesn't exist
+	err := s.createPartitionedWeatherTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Then make sure the coming months have their partitions
+	now := time.Now().UTC()
+	_, err = s.EnsureWeatherPartitions(ctx, now, now.AddDate(0, weatherPartitionsAhead, 0))
+	if err != nil {
+		return err
+	}
+
+	// Deleted readings are kept until purged once past the grace period
+	_, err = s.db.ExecContext(ctx, `
+        ALTER TABLE weather ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP NULL;
+        CREATE INDEX IF NOT EXISTS weather_deleted_at_idx ON weather (deleted_at) WHERE deleted_at IS NOT NULL;
     `)
 	if err != nil {
 		return err
@@ -25,7 +37,7 @@ func (s *PostgresStore) CreateWeatherTable() error {
 
 	// Check if the trigger already exists
 	var triggerExists bool
-	err = s.db.QueryRow(`
+	err = s.db.QueryRowContext(ctx, `
 		SELECT EXISTS(
 			SELECT 1 FROM pg_trigger 
          	WHERE tgname = 'weather_updated_at_trigger' 
@@ -38,7 +50,7 @@ func (s *PostgresStore) CreateWeatherTable() error {
 	// Create the trigger only if it doesn't exist
 	if !triggerExists {
 		// Create the trigger
-		_, err = s.db.Exec(`
+		_, err = s.db.ExecContext(ctx, `
             CREATE OR REPLACE FUNCTION update_timestamp()
             RETURNS TRIGGER AS $$
             BEGIN
@@ -61,8 +73,27 @@ func (s *PostgresStore) CreateWeatherTable() error {
 		}
 	}
 
+	// The created_at function is replaced on every start so existing
+	// databases pick up the import bypass: bulk imports set the
+	// weather.preserve_created_at setting to keep the original timestamps
+	_, err = s.db.ExecContext(ctx, `
+        CREATE OR REPLACE FUNCTION set_created_at()
+        RETURNS TRIGGER AS $$
+        BEGIN
+            IF current_setting('weather.preserve_created_at', true) = 'on' AND NEW.created_at IS NOT NULL THEN
+                RETURN NEW;
+            END IF;
+            NEW.created_at = NOW();
+            RETURN NEW;
+        END;
+        $$ LANGUAGE plpgsql;
+    `)
+	if err != nil {
+		return err
+	}
+
 	// Check if the createdAt trigger already exists
-	err = s.db.QueryRow(`
+	err = s.db.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 FROM pg_trigger 
             WHERE tgname = 'weather_created_at_trigger' 
@@ -75,15 +106,7 @@ func (s *PostgresStore) CreateWeatherTable() error {
 	// Create the trigger only if it doesn't exist
 	if !triggerExists {
 		// Create the trigger for created_at
-		_, err = s.db.Exec(`
-            CREATE OR REPLACE FUNCTION set_created_at()
-            RETURNS TRIGGER AS $$
-            BEGIN
-                NEW.created_at = NOW();
-                RETURN NEW;
-            END;
-            $$ LANGUAGE plpgsql;
-            
+		_, err = s.db.ExecContext(ctx, `
             CREATE TRIGGER weather_created_at_trigger
             BEFORE INSERT ON weather
             FOR EACH ROW
@@ -97,7 +120,10 @@ func (s *PostgresStore) CreateWeatherTable() error {
 	return nil
 }
 
-func (s *PostgresStore) CreateWeather(weather *Weather) error {
+func (s *PostgresStore) CreateWeather(ctx context.Context, weather *Weather) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		INSERT INTO weather (temperature, humidity, city_id, updated_at) 
 		VALUES ($1, $2, $3, NULL)
@@ -105,7 +131,8 @@ func (s *PostgresStore) CreateWeather(weather *Weather) error {
 	`
 
 	var id string
-	err := s.db.QueryRow(
+	err := s.db.QueryRowContext(
+		ctx,
 		query,
 		weather.Temperature,
 		weather.Humidity,
@@ -121,16 +148,116 @@ func (s *PostgresStore) CreateWeather(weather *Weather) error {
 	return nil
 }
 
-func (s *PostgresStore) GetWeatherByID(id string) (*Weather, error) {
-	rows, err := s.db.Query("SELECT * FROM weather WHERE id = $1", id)
+// CreateIdempotentWeather creates the reading and records it under key in
+// the same transaction, so that a retry of the request can't store it
+// again whenever the server stops.
+func (s *PostgresStore) CreateIdempotentWeather(ctx context.Context, weather *Weather, key *IdempotencyKey) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO weather (temperature, humidity, city_id, updated_at) 
+		VALUES ($1, $2, $3, NULL)
+		RETURNING id
+	`,
+		weather.Temperature,
+		weather.Humidity,
+		weather.CityID,
+	).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE idempotency_keys 
+		SET weather_id = $1 
+		WHERE device = $2 AND key = $3 AND created_at = $4
+	`, id, key.Device, key.Key, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	weather.ID = id
+	key.WeatherID = &id
+	return nil
+}
+
+// CopyWeathers bulk loads the readings with COPY in a single transaction,
+// keeping their CreatedAt instead of the insertion time, and returns how
+// many were stored. An error yielded by weathers, such as the upload being
+// cut off, rolls the whole load back.
+func (s *PostgresStore) CopyWeathers(ctx context.Context, weathers iter.Seq2[*Weather, error]) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Let the created_at trigger keep the imported timestamps
+	_, err = tx.ExecContext(ctx, "SET LOCAL weather.preserve_created_at = 'on'")
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("weather", "temperature", "humidity", "city_id", "created_at"))
+	if err != nil {
+		return 0, err
+	}
+
+	var copied int64
+	for weather, err := range weathers {
+		if err != nil {
+			stmt.Close()
+			return 0, err
+		}
+		_, err = stmt.ExecContext(ctx, weather.Temperature, weather.Humidity, weather.CityID, weather.CreatedAt)
+		if err != nil {
+			stmt.Close()
+			return 0, err
+		}
+		copied++
+	}
+
+	// Flush the buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return copied, nil
+}
+
+func (s *PostgresStore) GetWeatherByID(ctx context.Context, id string) (*Weather, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+weatherColumns+" FROM weather WHERE id = $1 AND "+notDeleted(ctx), id)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(rows *sql.Rows) {
+	defer func(rows *tracedRows) {
 		err := rows.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}(rows)
 
@@ -141,16 +268,19 @@ func (s *PostgresStore) GetWeatherByID(id string) (*Weather, error) {
 	return nil, fmt.Errorf("weather [%s] not found", id)
 }
 
-func (s *PostgresStore) GetWeathersByCityID(cityID string) ([]*Weather, error) {
-	rows, err := s.db.Query("SELECT * FROM weather WHERE city_id = $1", cityID)
+func (s *PostgresStore) GetWeathersByCityID(ctx context.Context, cityID string) ([]*Weather, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+weatherColumns+" FROM weather WHERE city_id = $1 AND "+notDeleted(ctx), cityID)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(rows *sql.Rows) {
+	defer func(rows *tracedRows) {
 		err := rows.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}(rows)
 
@@ -166,26 +296,37 @@ func (s *PostgresStore) GetWeathersByCityID(cityID string) ([]*Weather, error) {
 	return weathers, nil
 }
 
-func (s *PostgresStore) GetHourlyAveragesByCityID(cityID string) ([]map[string]interface{}, error) {
+// hourlyTotalsQuery selects the reading count and sums per hour of the
+// city $1 from the hourly aggregates, which the rollup triggers keep in
+// sync with the readings and which outlive them once pruned.
+const hourlyTotalsQuery = `
+	SELECT hour, reading_count, temperature_sum, humidity_sum
+	FROM weather_hourly_rollups
+	WHERE city_id = $1
+`
+
+func (s *PostgresStore) GetHourlyAveragesByCityID(ctx context.Context, cityID string) ([]map[string]interface{}, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		SELECT 
-			date_trunc('hour', created_at) AS hour,
-			AVG(temperature) AS avg_temperature,
-			AVG(humidity) AS avg_humidity
-		FROM weather
-		WHERE city_id = $1
+			hour,
+			SUM(temperature_sum) / SUM(reading_count) AS avg_temperature,
+			SUM(humidity_sum) / SUM(reading_count) AS avg_humidity
+		FROM (` + hourlyTotalsQuery + `) totals
 		GROUP BY hour
 		ORDER BY hour
 	`
 
-	rows, err := s.db.Query(query, cityID)
+	rows, err := s.db.QueryContext(ctx, query, cityID)
 	if err != nil {
 		return nil, err
 	}
-	defer func(rows *sql.Rows) {
+	defer func(rows *tracedRows) {
 		err := rows.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}(rows)
 
@@ -209,7 +350,176 @@ func (s *PostgresStore) GetHourlyAveragesByCityID(cityID string) ([]map[string]i
 	return results, nil
 }
 
-func scanIntoWeather(rows *sql.Rows) (*Weather, error) {
+func (s *PostgresStore) GetHourlySeriesByCityID(ctx context.Context, cityID string, since time.Time) ([]*HourlyAverage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT 
+			hour,
+			SUM(temperature_sum) / SUM(reading_count) AS avg_temperature,
+			SUM(humidity_sum) / SUM(reading_count) AS avg_humidity
+		FROM (` + hourlyTotalsQuery + `) totals
+		WHERE hour >= date_trunc('hour', $2::timestamp)
+		GROUP BY hour
+		ORDER BY hour
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, cityID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var series []*HourlyAverage
+	for rows.Next() {
+		average := new(HourlyAverage)
+		err := rows.Scan(&average.Hour, &average.Temperature, &average.Humidity)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, average)
+	}
+
+	return series, nil
+}
+
+// StreamWeathers calls fn for each reading matching q, oldest first, as
+// rows are read from the database instead of loading them all in memory.
+func (s *PostgresStore) StreamWeathers(ctx context.Context, q WeatherQuery, fn func(*Weather) error) error {
+	query := `
+		SELECT ` + weatherColumns + ` FROM weather
+		WHERE ($1 = '' OR city_id::text = $1) AND ($2::timestamp IS NULL OR created_at > $2) AND ` + notDeleted(ctx) + `
+		ORDER BY created_at
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, q.CityID, q.Since)
+	if err != nil {
+		return err
+	}
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		weather, err := scanIntoWeather(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(weather); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// StreamHourlyAveragesByCityID calls fn for each hourly average of the
+// city, oldest first. When last is positive only the last hours are sent.
+func (s *PostgresStore) StreamHourlyAveragesByCityID(ctx context.Context, cityID string, last int, fn func(*HourlyAverage) error) error {
+	query := `
+		SELECT hour, avg_temperature, avg_humidity FROM (
+			SELECT 
+				hour,
+				SUM(temperature_sum) / SUM(reading_count) AS avg_temperature,
+				SUM(humidity_sum) / SUM(reading_count) AS avg_humidity
+			FROM (` + hourlyTotalsQuery + `) totals
+			GROUP BY hour
+			ORDER BY hour DESC
+			LIMIT NULLIF($2, 0)
+		) averages
+		ORDER BY hour
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, cityID, last)
+	if err != nil {
+		return err
+	}
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		average := new(HourlyAverage)
+		err := rows.Scan(&average.Hour, &average.Temperature, &average.Humidity)
+		if err != nil {
+			return err
+		}
+		if err := fn(average); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetDailyAveragesByCityID returns the daily averages of the city, combining
+// the hourly aggregates with the daily ones kept by the retention policy
+// once hourly aggregates are pruned.
+func (s *PostgresStore) GetDailyAveragesByCityID(ctx context.Context, cityID string) ([]map[string]interface{}, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT 
+			day,
+			SUM(temperature_sum) / SUM(reading_count) AS avg_temperature,
+			SUM(humidity_sum) / SUM(reading_count) AS avg_humidity
+		FROM (
+			SELECT date_trunc('day', hour) AS day, reading_count, temperature_sum, humidity_sum
+			FROM (` + hourlyTotalsQuery + `) hourly
+			UNION ALL
+			SELECT day, reading_count, temperature_sum, humidity_sum
+			FROM weather_daily_rollups
+			WHERE city_id = $1
+		) totals
+		GROUP BY day
+		ORDER BY day
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, cityID)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *tracedRows) {
+		err := rows.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "closing rows", "error", err)
+		}
+	}(rows)
+
+	var results []map[string]interface{}
+	for rows.Next() {
+		var day string
+		var avgTemperature, avgHumidity float64
+
+		err := rows.Scan(&day, &avgTemperature, &avgHumidity)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, map[string]interface{}{
+			"day":         day,
+			"temperature": avgTemperature,
+			"humidity":    avgHumidity,
+		})
+	}
+
+	return results, nil
+}
+
+func scanIntoWeather(rows *tracedRows) (*Weather, error) {
 	weather := new(Weather)
 	err := rows.Scan(
 		&weather.ID,
@@ -218,21 +528,25 @@ func scanIntoWeather(rows *sql.Rows) (*Weather, error) {
 		&weather.CityID,
 		&weather.CreatedAt,
 		&weather.UpdatedAt,
+		&weather.DeletedAt,
 	)
 
 	return weather, err
 }
 
-func (s *PostgresStore) GetWeathers() ([]*Weather, error) {
-	rows, err := s.db.Query("SELECT * FROM weather")
+func (s *PostgresStore) GetWeathers(ctx context.Context) ([]*Weather, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+weatherColumns+" FROM weather WHERE "+notDeleted(ctx))
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(rows *sql.Rows) {
+	defer func(rows *tracedRows) {
 		err := rows.Close()
 		if err != nil {
-			log.Fatal(err)
+			slog.ErrorContext(ctx, "closing rows", "error", err)
 		}
 	}(rows)
 
@@ -248,37 +562,74 @@ func (s *PostgresStore) GetWeathers() ([]*Weather, error) {
 	return weathers, nil
 }
 
-func (s *PostgresStore) UpdateWeather(weather *Weather) error {
+func (s *PostgresStore) UpdateWeather(ctx context.Context, weather *Weather) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		UPDATE weather 
 		SET temperature = $1, humidity = $2, city_id = $3, updated_at = NOW() 
-		WHERE id = $4
+		WHERE id = $4 AND deleted_at IS NULL
 	`
 
-	_, err := s.db.Exec(
-		query,
-		weather.Temperature,
-		weather.Humidity,
-		weather.CityID,
-		weather.ID,
-	)
-	if err != nil {
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		_, err := tx.ExecContext(
+			ctx,
+			query,
+			weather.Temperature,
+			weather.Humidity,
+			weather.CityID,
+			weather.ID,
+		)
 		return err
-	}
-
-	return nil
+	})
 }
 
-func (s *PostgresStore) DeleteWeather(id string) error {
+// DeleteWeather marks the reading deleted, which takes it out of the
+// queries and the hourly aggregates until purged.
+func (s *PostgresStore) DeleteWeather(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-		DELETE FROM weather 
-		WHERE id = $1
+		UPDATE weather 
+		SET deleted_at = NOW() 
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
-	_, err := s.db.Exec(query, id)
-	if err != nil {
+	return s.inAuditedTx(ctx, func(tx *tracedTx) error {
+		_, err := tx.ExecContext(ctx, query, id)
 		return err
+	})
+}
+
+// PurgeDeletedWeathers deletes for good the readings deleted before cutoff
+// and returns how many were purged.
+func (s *PostgresStore) PurgeDeletedWeathers(ctx context.Context, cutoff time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	return nil
+	// Their deletion is already in the audit log
+	_, err = tx.ExecContext(ctx, "SET LOCAL weather.skip_audit = 'on'")
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM weather 
+		WHERE deleted_at < $1
+	`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit()
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// readingStatusHeader tells stations what was done with the reading sent.
+const readingStatusHeader = "X-Reading-Status"
+
+// What ReadingThrottle.Save did with a reading.
+const (
+	ReadingStored  = "stored"
+	ReadingDropped = "dropped"
+	ReadingMerged  = "merged"
+)
+
+// Modes of ReadingThrottle for the readings coming too soon.
+const (
+	ReadingModeDrop  = "drop"
+	ReadingModeMerge = "merge"
+)
+
+// ReadingThrottle enforces a minimum interval between the stored readings
+// of every device. The readings a device sends sooner are dropped, or
+// merged into its last stored reading, which then holds their average.
+type ReadingThrottle struct {
+	store    Storage
+	interval time.Duration
+	merge    bool
+
+	mu        sync.Mutex
+	devices   map[string]*throttledDevice
+	lastSweep time.Time
+}
+
+// throttledDevice is the last reading stored for a device and the readings
+// merged into it.
+type throttledDevice struct {
+	mu          sync.Mutex
+	weatherID   string
+	cityID      string
+	storedAt    time.Time
+	count       int
+	temperature float64
+	humidity    float64
+}
+
+// NewReadingThrottle creates a new instance of ReadingThrottle. With an
+// interval of 0 every reading is stored.
+func NewReadingThrottle(store Storage, interval time.Duration, mode string) *ReadingThrottle {
+	return &ReadingThrottle{
+		store:    store,
+		interval: interval,
+		merge:    mode == ReadingModeMerge,
+		devices:  make(map[string]*throttledDevice),
+	}
+}
+
+// Save stores the reading sent by device unless it comes within the
+// interval of the last one stored for it. It returns the ID of the reading
+// holding its values and whether it was stored, dropped or merged. A
+// reading stored under an idempotency key completes the key with it.
+func (t *ReadingThrottle) Save(ctx context.Context, device string, weather *Weather, key *IdempotencyKey) (string, string, error) {
+	if t.interval <= 0 {
+		if err := t.create(ctx, weather, key); err != nil {
+			return "", "", err
+		}
+		return weather.ID, ReadingStored, nil
+	}
+
+	now := time.Now()
+
+	// Readings of the same device are handled one at a time
+	last := t.lockDevice(device, now)
+	defer last.mu.Unlock()
+
+	// A device moved to another city starts over
+	if last.weatherID == "" || last.cityID != weather.CityID || now.Sub(last.storedAt) >= t.interval {
+		if err := t.create(ctx, weather, key); err != nil {
+			return "", "", err
+		}
+		last.weatherID = weather.ID
+		last.cityID = weather.CityID
+		last.storedAt = now
+		last.count = 1
+		last.temperature = weather.Temperature
+		last.humidity = weather.Humidity
+		return weather.ID, ReadingStored, nil
+	}
+
+	if !t.merge {
+		slog.DebugContext(ctx, "reading dropped", "device", device, "weather_id", last.weatherID)
+		return last.weatherID, ReadingDropped, nil
+	}
+
+	count := last.count + 1
+	merged := &Weather{
+		ID:          last.weatherID,
+		Temperature: (last.temperature*float64(last.count) + weather.Temperature) / float64(count),
+		Humidity:    (last.humidity*float64(last.count) + weather.Humidity) / float64(count),
+		CityID:      weather.CityID,
+	}
+	if err := t.store.UpdateWeather(ctx, merged); err != nil {
+		return "", "", err
+	}
+	last.count = count
+	last.temperature = merged.Temperature
+	last.humidity = merged.Humidity
+
+	slog.DebugContext(ctx, "reading merged", "device", device, "weather_id", last.weatherID, "count", count)
+	return last.weatherID, ReadingMerged, nil
+}
+
+// lockDevice returns the entry of device, locked. An entry swept before it
+// could be locked is left for a new one, so that every reading of the
+// device goes through the same entry.
+func (t *ReadingThrottle) lockDevice(device string, now time.Time) *throttledDevice {
+	for {
+		t.mu.Lock()
+		t.sweep(now)
+		last, ok := t.devices[device]
+		if !ok {
+			last = &throttledDevice{}
+			t.devices[device] = last
+		}
+		t.mu.Unlock()
+
+		last.mu.Lock()
+		t.mu.Lock()
+		current := t.devices[device] == last
+		t.mu.Unlock()
+		if current {
+			return last
+		}
+		last.mu.Unlock()
+	}
+}
+
+func (t *ReadingThrottle) create(ctx context.Context, weather *Weather, key *IdempotencyKey) error {
+	if key == nil {
+		return t.store.CreateWeather(ctx, weather)
+	}
+	return t.store.CreateIdempotentWeather(ctx, weather, key)
+}
+
+// RetryAfter returns how long until device may send a reading which is
+// stored as a new one.
+func (t *ReadingThrottle) RetryAfter(device string) time.Duration {
+	t.mu.Lock()
+	last, ok := t.devices[device]
+	t.mu.Unlock()
+	if !ok {
+		return 0
+	}
+
+	last.mu.Lock()
+	defer last.mu.Unlock()
+	return max(0, t.interval-time.Since(last.storedAt))
+}
+
+// sweep forgets the devices whose interval is over, so that the devices
+// no longer sending readings don't pile up.
+func (t *ReadingThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.interval {
+		return
+	}
+	t.lastSweep = now
+
+	for device, last := range t.devices {
+		// Devices busy saving a reading are kept
+		if !last.mu.TryLock() {
+			continue
+		}
+		if now.Sub(last.storedAt) >= t.interval {
+			delete(t.devices, device)
+		}
+		last.mu.Unlock()
+	}
+}
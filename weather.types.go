@@ -9,12 +9,36 @@ type Weather struct {
 	CityID      string     `json:"city_id"`
 	CreatedAt   time.Time  `json:"created_at"`
 	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+type HourlyAverage struct {
+	Hour        time.Time `json:"hour"`
+	Temperature float64   `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+}
+
+// WeatherQuery narrows the weather readings streamed from the store.
+type WeatherQuery struct {
+	CityID string
+	Since  *time.Time
+}
+
+// WeatherPartition is a monthly partition of the weather table holding the
+// readings created from From up to To.
+type WeatherPartition struct {
+	Name string    `json:"name"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
 }
 
 type CreateWeatherRequest struct {
 	Temperature float64 `json:"temperature"`
 	Humidity    float64 `json:"humidity"`
 	CityID      string  `json:"city_id"`
+	// Sequence numbers the readings of a device so that its retries are
+	// stored once, like an Idempotency-Key
+	Sequence *int64 `json:"sequence,omitempty"`
 }
 
 func NewWeather(